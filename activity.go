@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"sync"
+	"time"
+)
+
+// Name given to the sessions of low-runner when the connection string does
+// not set one, it is used to find them in pg_stat_activity
+const defaultApplicationName = "low-runner"
+
+// activitySample summarizes the sessions of low-runner found in
+// pg_stat_activity at some point
+type activitySample struct {
+	Time time.Time
+
+	// Number of sessions and the ones blocked by another session
+	Backends int
+	Blocked  int
+
+	// Sessions by state and wait event
+	Waits []activityWait
+}
+
+type activityWait struct {
+	State     string
+	EventType string
+	Event     string
+	Count     int
+}
+
+// activitySampler keeps the last sample taken and the error of the last
+// attempt, for the REST API
+type activitySampler struct {
+	m    sync.RWMutex
+	last activitySample
+	err  error
+}
+
+func (a *activitySampler) get() (activitySample, error) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	return a.last, a.err
+}
+
+func (a *activitySampler) set(s activitySample, err error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if err == nil {
+		a.last = s
+	}
+	a.err = err
+}
+
+const activityQuery = `SELECT coalesce(state, ''), coalesce(wait_event_type, ''), coalesce(wait_event, ''),
+  count(*), count(*) FILTER (WHERE cardinality(pg_blocking_pids(pid)) > 0)
+FROM pg_stat_activity
+WHERE application_name = $1 AND pid <> pg_backend_pid()
+GROUP BY 1, 2, 3
+ORDER BY 4 DESC`
+
+// sampleActivity queries pg_stat_activity every interval on a dedicated
+// connection, so that sampling does not take connections from the pools,
+// until ctx is done. The connection is opened again on errors.
+func sampleActivity(ctx context.Context, connConfig *pgx.ConnConfig, interval time.Duration, a *activitySampler) {
+	appName := connConfig.RuntimeParams["application_name"]
+
+	config := connConfig.Copy()
+	config.RuntimeParams["application_name"] = appName + " sampler"
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = pgx.ConnectConfig(ctx, config)
+			if err != nil {
+				// The error is also shown by the REST API
+				err = redactError(err, config.ConnString(), config.Password)
+				log.Printf("activity sampler could not connect: %s", err)
+				a.set(activitySample{}, err)
+				conn = nil
+				continue
+			}
+		}
+
+		s, err := takeActivitySample(ctx, conn, appName)
+		if err != nil {
+			err = redactError(err, config.ConnString(), config.Password)
+			log.Printf("activity sampling failed: %s", err)
+			conn.Close(context.Background())
+			conn = nil
+		}
+
+		a.set(s, err)
+	}
+}
+
+func takeActivitySample(ctx context.Context, conn *pgx.Conn, appName string) (activitySample, error) {
+	s := activitySample{
+		Time:  time.Now(),
+		Waits: make([]activityWait, 0),
+	}
+
+	rows, err := conn.Query(ctx, activityQuery, appName)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			w       activityWait
+			blocked int
+		)
+
+		if err := rows.Scan(&w.State, &w.EventType, &w.Event, &w.Count, &blocked); err != nil {
+			return s, err
+		}
+
+		s.Backends += w.Count
+		s.Blocked += blocked
+		s.Waits = append(s.Waits, w)
+	}
+
+	return s, rows.Err()
+}
@@ -1,75 +1,464 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type apiRun struct {
 	Schedule apiSchedule `json:"schedule"`
 	Work     apiWork     `json:"work"`
+
+	// Defaults for the options, only read from the work file
+	ApiListenAddr string `json:"api_listen_addr,omitempty"`
+	DbUrl         string `json:"db_url,omitempty"`
+}
+
+type apiRunInfo struct {
+	Name     string      `json:"name"`
+	Schedule apiSchedule `json:"schedule"`
 }
 
 type apiSchedule struct {
-	Workers   int    `json:"workers"`
-	Frequency string `json:"frequency"`
-	Pause     bool   `json:"pause"`
+	Workers        int    `json:"workers"`
+	Frequency      string `json:"frequency"`
+	Pause          bool   `json:"pause"`
+	MaxConcurrency int    `json:"max_concurrency,omitempty"`
+	Ordered        bool   `json:"ordered,omitempty"`
+	Timeline       string `json:"timeline,omitempty"`
+}
+
+// apiScheduleStatus is the schedule along with its last change from the API
+type apiScheduleStatus struct {
+	apiSchedule
+	LastChange *apiScheduleChange `json:"last_change,omitempty"`
+}
+
+type apiScheduleChange struct {
+	Time    string `json:"time"`
+	Changes string `json:"changes"`
 }
 
 type apiWork struct {
-	Xacts []apiXact `json:"xacts"`
+	Xacts  []apiXact `json:"xacts"`
+	Listen []string  `json:"listen,omitempty"`
+
+	// Values of the ${NAME} references of the statements, expanded when
+	// the xacts are added
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// apiApply is a set of changes applied to a run at once
+type apiApply struct {
+	Schedule *apiSchedule `json:"schedule,omitempty"`
+	Add      []apiXact    `json:"add,omitempty"`
+	Remove   []string     `json:"remove,omitempty"`
 }
 
 type apiXact struct {
-	Id         string   `json:"id,omitempty"`
-	Outcome    string   `json:"outcome,omitempty"`
-	Statements []string `json:"statements"`
+	Id           string            `json:"id,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Outcome      string            `json:"outcome,omitempty"`
+	Hold         string            `json:"hold,omitempty"`
+	Autocommit   bool              `json:"autocommit,omitempty"`
+	Enabled      *bool             `json:"enabled,omitempty"`
+	ServerTiming bool              `json:"server_timing,omitempty"`
+	MaxRetries   int               `json:"max_retries,omitempty"`
+	Settings     map[string]string `json:"settings,omitempty"`
+	Statements   []apiStmt         `json:"statements"`
+
+	WorkerMultiplier int `json:"worker_multiplier,omitempty"`
+
+	// Id of the xact before a change giving it a new id, only in the
+	// responses
+	PreviousId string `json:"previous_id,omitempty"`
+
+	// SQL script split into statements, in place of the statements, only
+	// read from the payloads
+	Script string `json:"script,omitempty"`
+
+	// Only given when getting a single xact
+	Counters *apiXactCounters `json:"counters,omitempty"`
+}
+
+type apiXactCounters struct {
+	Commits     int64  `json:"commits"`
+	Rollbacks   int64  `json:"rollbacks"`
+	Terminated  int64  `json:"terminated"`
+	Held        int64  `json:"held"`
+	NotRun      int64  `json:"not_run"`
+	MeanLatency string `json:"mean_latency"`
+	LastOutcome string `json:"last_outcome"`
+}
+
+// apiStmt is a statement of a xact, given as a SQL string or as an object when
+// more than the SQL text is needed
+type apiStmt struct {
+	Sql     string    `json:"sql,omitempty"`
+	Copy    *copyFrom `json:"copy,omitempty"`
+	Timeout string    `json:"timeout,omitempty"`
+
+	ExpectRows *rowRange `json:"expect_rows,omitempty"`
+	MaxRows    int       `json:"max_rows,omitempty"`
+	FetchSize  int       `json:"fetch_size,omitempty"`
+	Params     []param   `json:"params,omitempty"`
+
+	Sleep  string `json:"sleep,omitempty"`
+	Jitter string `json:"jitter,omitempty"`
+}
+
+// isPlain tells if the statement can be given as a string
+func (s apiStmt) isPlain() bool {
+	return s.Copy == nil && s.Timeout == "" && s.ExpectRows == nil && s.MaxRows == 0 && s.FetchSize == 0 && len(s.Params) == 0 && s.Sleep == ""
+}
+
+func (s *apiStmt) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*s = apiStmt{Sql: text}
+		return nil
+	}
+
+	// Use another type to avoid calling this method again
+	type object apiStmt
+	var o object
+	if err := json.Unmarshal(data, &o); err != nil {
+		return err
+	}
+
+	*s = apiStmt(o)
+	return nil
+}
+
+func (s apiStmt) MarshalJSON() ([]byte, error) {
+	if s.isPlain() {
+		return json.Marshal(s.Sql)
+	}
+
+	type object apiStmt
+	return json.Marshal(object(s))
+}
+
+type apiStats struct {
+	Interval       string  `json:"interval"`
+	Window         string  `json:"window"`
+	Instant        float64 `json:"instant_xacts_per_sec"`
+	Average        float64 `json:"avg_xacts_per_sec"`
+	Failures       int     `json:"failures"`
+	InFlight       int64   `json:"in_flight"`
+	Queued         int64   `json:"queued"`
+	Held           int64   `json:"held"`
+	AcquireWaiting int64   `json:"acquire_waiting"`
+	ResultsQueue   int     `json:"results_queue"`
+	ResultsCap     int     `json:"results_cap"`
+	StartedAt      string  `json:"started_at"`
+	Uptime         string  `json:"uptime"`
+	SendBlocked    string  `json:"send_blocked"`
+
+	Notifications int64  `json:"notifications"`
+	NotifyLatency string `json:"notify_latency"`
+
+	RowsCopied int64 `json:"rows_copied"`
+
+	AcquireWait   apiLatencies   `json:"acquire_wait"`
+	ExecTime      apiLatencies   `json:"exec_time"`
+	Connects      int            `json:"connects"`
+	ConnectTime   apiLatencies   `json:"connect_time"`
+	AcquireErrors map[string]int `json:"acquire_errors"`
+	NotBegun      int            `json:"not_begun"`
+	ServerTime    apiLatencies   `json:"server_time"`
+	FetchTime     apiLatencies   `json:"fetch_time"`
+	TotalTime     apiSpread      `json:"total_time"`
+
+	BreakerTripped bool `json:"breaker_tripped"`
+}
+
+type apiLatencies struct {
+	P50 string `json:"p50"`
+	P95 string `json:"p95"`
+	P99 string `json:"p99"`
+}
+
+// apiHistogram gives the count of xacts for each bucket of total latency, a
+// bucket counts the xacts slower than the previous one and not slower than
+// its upper bound, le
+type apiHistogram struct {
+	Count   int64       `json:"count"`
+	Buckets []apiBucket `json:"buckets"`
+}
+
+type apiBucket struct {
+	Le    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+type apiFailure struct {
+	XactId   string `json:"xact_id"`
+	XactName string `json:"xact_name,omitempty"`
+	Trace    string `json:"trace,omitempty"`
+	Time     string `json:"time"`
+	Outcome  string `json:"outcome"`
+	Error    string `json:"error,omitempty"`
+	SQLState string `json:"sqlstate,omitempty"`
+}
+
+type apiXactError struct {
+	SQLState string `json:"sqlstate"`
+	Count    int64  `json:"count"`
+	LastSeen string `json:"last_seen"`
+}
+
+type apiSpread struct {
+	Min    string `json:"min"`
+	Max    string `json:"max"`
+	Mean   string `json:"mean"`
+	Stddev string `json:"stddev"`
+}
+
+type apiXactRun struct {
+	Id         string          `json:"id"`
+	Name       string          `json:"name,omitempty"`
+	Trace      string          `json:"trace,omitempty"`
+	Outcome    string          `json:"outcome"`
+	Duration   string          `json:"duration,omitempty"`
+	Acquire    string          `json:"acquire,omitempty"`
+	Connect    string          `json:"connect,omitempty"`
+	Retries    int             `json:"retries,omitempty"`
+	Statements []apiStmtResult `json:"statements"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// apiRunOnce are the options of a single pass over the xacts of a run
+type apiRunOnce struct {
+	StopOnError bool `json:"stop_on_error"`
+}
+
+// apiRunOnceResult gives the results of a single pass, in order
+type apiRunOnceResult struct {
+	Xacts    []apiXactRun `json:"xacts"`
+	Failures int          `json:"failures"`
+	NotRun   int          `json:"not_run"`
+}
+
+type apiStmtResult struct {
+	Sql          string `json:"sql"`
+	Duration     string `json:"duration"`
+	Rows         int    `json:"rows"`
+	RowsAffected int64  `json:"rows_affected"`
+	TimedOut     bool   `json:"timed_out,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+	Fetches      int    `json:"fetches,omitempty"`
+	ServerTime   string `json:"server_time,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// apiConfig is the configuration resolved from the command line, the
+// environment and the defaults, without secrets
+type apiConfig struct {
+	ApiListenAddr     string   `json:"api_listen_addr"`
+	MetricsListenAddr string   `json:"metrics_listen_addr"`
+	CorsOrigins       []string `json:"cors_origins"`
+	GzipMinSize       int      `json:"gzip_min_size"`
+	AccessLog         string   `json:"access_log"`
+	Quiet             bool     `json:"quiet"`
+	Verbose           bool     `json:"verbose"`
+	WorkFile          string   `json:"work_file"`
+	StrictWorkFile    bool     `json:"strict_workfile"`
+	WatchWorkFile     bool     `json:"watch_workfile"`
+	DbUrl             string   `json:"db_url"`
+	PasswordFile      string   `json:"db_password_file"`
+	SslMode           string   `json:"sslmode"`
+	SslRootCert       string   `json:"sslrootcert"`
+	SslCert           string   `json:"sslcert"`
+	SslKey            string   `json:"sslkey"`
+	LazyConnect       bool     `json:"lazy_connect"`
+	ConnectRetries    int      `json:"connect_retries"`
+	ConnectTimeout    string   `json:"connect_timeout"`
+	NoPool            bool     `json:"no_pool"`
+	Protocol          string   `json:"protocol"`
+	StatementCache    string   `json:"statement_cache"`
+	Warmup            bool     `json:"warmup"`
+	StatsInterval     string   `json:"stats_interval"`
+	StatsWindow       int      `json:"stats_window"`
+	HistogramSteps    int      `json:"histogram_steps"`
+	MaxFailures       int      `json:"max_failures"`
+	MaxInflight       int      `json:"max_inflight"`
+	AcquireWarn       int      `json:"acquire_warn"`
+	TagQueries        bool     `json:"tag_queries"`
+	SlowXact          string   `json:"slow_xact"`
+	ResultsBuffer     int      `json:"results_buffer"`
+	PgbenchLog        string   `json:"pgbench_log"`
+	Seed              int64    `json:"seed"`
+	PgSetseed         bool     `json:"pg_setseed"`
+	SampleActivity    string   `json:"sample_activity"`
+	XactIdHash        string   `json:"xact_id_hash"`
+	XactIdLength      int      `json:"xact_id_length"`
+	XactIdNormalize   string   `json:"xact_id_normalize"`
+	Ramp              string   `json:"ramp"`
+
+	BreakerThreshold float64 `json:"breaker_threshold"`
+	BreakerWindow    int     `json:"breaker_window"`
+	BreakerExit      bool    `json:"breaker_exit"`
+
+	MaxFailureRate    float64 `json:"max_failure_rate"`
+	MaxFailureWindows int     `json:"max_failure_windows"`
+
+	Vars map[string]string `json:"vars,omitempty"`
+
+	Pool apiPoolConfig `json:"pool"`
+}
+
+// apiPoolConfig shows the settings of the pools given to new runs, the size
+// of the pool of a run then follows its number of workers
+type apiPoolConfig struct {
+	MaxConns          int32  `json:"max_conns"`
+	MinConns          int32  `json:"min_conns"`
+	MaxConnLifetime   string `json:"max_conn_lifetime"`
+	MaxConnIdleTime   string `json:"max_conn_idle_time"`
+	HealthCheckPeriod string `json:"health_check_period"`
+}
+
+type apiActivity struct {
+	Time     string            `json:"time"`
+	Backends int               `json:"backends"`
+	Blocked  int               `json:"blocked"`
+	Waits    []apiActivityWait `json:"waits"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type apiActivityWait struct {
+	State     string `json:"state"`
+	EventType string `json:"wait_event_type"`
+	Event     string `json:"wait_event"`
+	Count     int    `json:"count"`
+}
+
+// apiExec is a one-off command to run on the database
+type apiExec struct {
+	Sql         string `json:"sql"`
+	Transaction bool   `json:"transaction,omitempty"`
+}
+
+type apiExecResult struct {
+	CommandTag string `json:"command_tag"`
+	Duration   string `json:"duration"`
+	Error      string `json:"error,omitempty"`
 }
 
 type apiError struct {
 	Error string `json:"error"`
 }
 
+type apiHealth struct {
+	Status string `json:"status"`
+}
+
 func scheduleToApiSchedule(d ctrlData) apiSchedule {
 	return apiSchedule{
-		Workers:   d.Workers,
-		Frequency: d.Frequency.String(),
-		Pause:     d.Pause,
+		Workers:        d.Workers,
+		Frequency:      d.Frequency.String(),
+		Pause:          d.Pause,
+		MaxConcurrency: d.MaxConcurrency,
+		Ordered:        d.Ordered,
+		Timeline:       d.Timeline,
+	}
+}
+
+// parseFrequency reads the interval between the rounds of the schedule,
+// given as a duration, like 500ms, or as a number of rounds per second,
+// minute or hour, like 500/s or 30/m. The interval must be positive, the
+// tickers of dispatch cannot run otherwise.
+func parseFrequency(s string) (time.Duration, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		f, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+
+		if f <= 0 {
+			return 0, fmt.Errorf("invalid duration %q, it must be positive", s)
+		}
+
+		return f, nil
 	}
+
+	var per time.Duration
+	switch strings.TrimSpace(s[i+1:]) {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, fmt.Errorf("invalid rate %q, the unit must be s, m or h", s)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s[:i]), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, the count must be a positive number", s)
+	}
+
+	f := time.Duration(float64(per) / n)
+	if f <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, it is too high", s)
+	}
+
+	return f, nil
 }
 
 func apiScheduleToSchedule(s apiSchedule) (ctrlData, error) {
 	d := ctrlData{}
 
-	f, err := time.ParseDuration(s.Frequency)
+	f, err := parseFrequency(s.Frequency)
 	if err != nil {
-		return d, fmt.Errorf("invalid value for frequency")
+		return d, fmt.Errorf("invalid value for frequency: %w", err)
 	}
 
 	if s.Workers < 1 {
 		return d, fmt.Errorf("workers must be greater than or equal to 1")
 	}
 
+	if s.MaxConcurrency < 0 {
+		return d, fmt.Errorf("max_concurrency must be greater than or equal to 0")
+	}
+
+	if s.Timeline != "" {
+		if _, err := loadTimeline(s.Timeline); err != nil {
+			return d, err
+		}
+	}
+
 	d.Frequency = f
 	d.Workers = s.Workers
 	d.Pause = s.Pause
+	d.MaxConcurrency = s.MaxConcurrency
+	d.Ordered = s.Ordered
+	d.Timeline = s.Timeline
 
 	return d, nil
 }
 
 func runInfoToApiWork(r runInfo, omitIds bool) apiWork {
 	w := apiWork{
-		Xacts: make([]apiXact, 0, len(r.Xacts)),
+		Xacts:     make([]apiXact, 0, len(r.Xacts)),
+		Listen:    r.Listen,
+		Variables: r.Vars,
 	}
 
-	for _, v := range r.Xacts {
+	for _, v := range r.ordered() {
 		ax := xactToApiXact(v)
 		if omitIds {
 			ax.Id = ""
@@ -81,270 +470,1499 @@ func runInfoToApiWork(r runInfo, omitIds bool) apiWork {
 	return w
 }
 
-func apiWorkToRunInfo(a apiWork) runInfo {
+func apiWorkToRunInfo(a apiWork) (runInfo, error) {
+	if err := checkVars(a.Variables); err != nil {
+		return runInfo{}, err
+	}
+
 	xl := make([]xact, 0, len(a.Xacts))
 
 	for _, ax := range a.Xacts {
-		xl = append(xl, apiXactToXact(ax))
+		x, err := apiXactToXact(ax, a.Variables)
+		if err != nil {
+			return runInfo{}, err
+		}
+
+		xl = append(xl, x)
 	}
 
-	return newRunInfo(xl)
+	ri := newRunInfo(xl)
+	ri.Vars = a.Variables
+
+	for _, ch := range a.Listen {
+		if ch == "" {
+			return runInfo{}, fmt.Errorf("empty channel name in listen")
+		}
+
+		ri.Listen = append(ri.Listen, ch)
+	}
+
+	return ri, nil
 }
 
 func xactToApiXact(x xact) apiXact {
-	ax := apiXact{Id: x.id, Outcome: string(x.Outcome)}
-	stmts := make([]string, 0)
+	enabled := x.Enabled
+	ax := apiXact{Id: x.id, Name: x.Name, Outcome: string(x.Outcome), Autocommit: x.Autocommit, Enabled: &enabled, ServerTiming: x.ServerTiming, MaxRetries: x.MaxRetries, Settings: x.Settings, WorkerMultiplier: x.WorkerMultiplier}
+	if x.Hold > 0 {
+		ax.Hold = x.Hold.String()
+	}
+
+	stmts := make([]apiStmt, 0)
 	for _, s := range x.Statements {
-		stmts = append(stmts, s.Text)
+		stmts = append(stmts, stmtToApiStmt(s))
 	}
 
 	ax.Statements = stmts
 	return ax
 }
 
-func apiXactToXact(a apiXact) xact {
-	x := newXact(a.Statements)
-
-	if a.Outcome != "" {
-		x.Outcome = xactOutcome(a.Outcome)
-		x.genSource()
+// changedXactToApiXact gives a xact after a change, the previous id is given
+// when the change made the id change, so that clients know the one to use
+func changedXactToApiXact(x xact, previousId string) apiXact {
+	ax := xactToApiXact(x)
+	if x.id != previousId {
+		ax.PreviousId = previousId
 	}
 
-	return x
+	return ax
 }
 
-// API actions: they all get the pointer to the run to edit it, the mutex must
-// be used when reading and writing the run
+// apiXactToXact checks a xact and expands the variables of its statements,
+// vars are the ones of the run
+func apiXactToXact(a apiXact, vars map[string]string) (xact, error) {
+	x := xact{
+		Name:         a.Name,
+		Outcome:      Commit,
+		Autocommit:   a.Autocommit,
+		Enabled:      true,
+		ServerTiming: a.ServerTiming,
+		MaxRetries:   a.MaxRetries,
+		Statements:   make([]stmt, 0, len(a.Statements)),
+	}
 
-func getXact(c echo.Context, r *run) error {
-	id := c.Param("id")
+	if a.Enabled != nil {
+		x.Enabled = *a.Enabled
+	}
 
-	r.m.RLock()
-	defer r.m.RUnlock()
+	if a.Outcome != "" {
+		o, err := parseOutcome(a.Outcome)
+		if err != nil {
+			return xact{}, err
+		}
+		x.Outcome = o
+	}
 
-	x, err := r.Work.get(id)
-	if err != nil {
-		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	if a.Hold != "" {
+		h, err := time.ParseDuration(a.Hold)
+		if err != nil {
+			return xact{}, fmt.Errorf("invalid hold: %w", err)
+		}
+		x.Hold = h
 	}
 
-	ax := xactToApiXact(x)
+	if err := checkHold(x.Outcome, x.Hold, x.Autocommit); err != nil {
+		return xact{}, err
+	}
 
-	return c.JSON(http.StatusOK, ax)
-}
+	if a.MaxRetries < 0 {
+		return xact{}, fmt.Errorf("max retries must be greater than or equal to 0")
+	}
 
-func getAllXacts(c echo.Context, r *run) error {
-	r.m.RLock()
-	defer r.m.RUnlock()
+	if a.WorkerMultiplier < 0 {
+		return xact{}, fmt.Errorf("worker multiplier must be positive")
+	}
+	x.WorkerMultiplier = a.WorkerMultiplier
 
-	return c.JSON(http.StatusOK, runInfoToApiWork(r.Work, false))
-}
+	if len(a.Settings) > 0 {
+		if a.Autocommit {
+			return xact{}, fmt.Errorf("settings are set with SET LOCAL, they need a transaction, not autocommit")
+		}
 
-func addXact(c echo.Context, r *run) error {
-	ax := apiXact{}
-	if err := c.Bind(&ax); err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+		if err := validateSettings(a.Settings); err != nil {
+			return xact{}, err
+		}
+
+		x.Settings = a.Settings
 	}
 
-	x := newXact(ax.Statements)
+	if a.Script != "" {
+		if len(a.Statements) > 0 {
+			return xact{}, fmt.Errorf("script and statements cannot be given together")
+		}
 
-	r.m.Lock()
-	err := r.Work.add(x)
-	r.m.Unlock()
+		script, err := expandVars(a.Script, vars)
+		if err != nil {
+			return xact{}, err
+		}
 
-	if err != nil {
-		return c.JSON(http.StatusConflict, apiError{err.Error()})
+		texts, err := splitScript(script)
+		if err != nil {
+			return xact{}, err
+		}
+
+		for _, t := range texts {
+			a.Statements = append(a.Statements, apiStmt{Sql: t})
+		}
 	}
 
-	ax.Id = x.id
+	for _, as := range a.Statements {
+		sql, err := expandVars(as.Sql, vars)
+		if err != nil {
+			return xact{}, err
+		}
+		as.Sql = sql
 
-	return c.JSON(http.StatusCreated, ax)
-}
+		s, err := apiStmtToStmt(as)
+		if err != nil {
+			return xact{}, err
+		}
 
-func updateXact(c echo.Context, r *run) error {
-	id := c.Param("id")
+		// Cursors only live in a transaction, and EXPLAIN cannot wrap a
+		// DECLARE
+		if s.FetchSize > 0 && a.Autocommit {
+			return xact{}, fmt.Errorf("statements with a fetch_size use a cursor, they need a transaction, not autocommit")
+		}
 
-	ax := apiXact{}
-	if err := c.Bind(&ax); err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+		if s.FetchSize > 0 && a.ServerTiming {
+			return xact{}, fmt.Errorf("statements with a fetch_size cannot be run with server timing")
+		}
+
+		x.Statements = append(x.Statements, s)
 	}
 
-	x := newXact(ax.Statements)
+	x.genSource()
 
-	r.m.Lock()
-	newX, err := r.Work.appendXact(id, x)
-	r.m.Unlock()
+	return x, nil
+}
 
-	if err != nil {
-		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+func stmtToApiStmt(s stmt) apiStmt {
+	a := apiStmt{Sql: s.Text, Copy: s.Copy, ExpectRows: s.ExpectRows, MaxRows: s.MaxRows, FetchSize: s.FetchSize, Params: s.Params}
+	if s.Timeout > 0 {
+		a.Timeout = s.Timeout.String()
+	}
+
+	if s.Sleep > 0 {
+		a.Sleep = s.Sleep.String()
 	}
 
-	return c.JSON(http.StatusOK, xactToApiXact(newX))
+	if s.Jitter > 0 {
+		a.Jitter = s.Jitter.String()
+	}
+
+	return a
 }
 
-func replaceXact(c echo.Context, r *run) error {
-	id := c.Param("id")
+func apiStmtToStmt(a apiStmt) (stmt, error) {
+	if a.Copy != nil {
+		if a.Sql != "" {
+			return stmt{}, fmt.Errorf("a copy statement cannot have sql")
+		}
 
-	ax := apiXact{}
-	if err := c.Bind(&ax); err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+		if err := a.Copy.validate(); err != nil {
+			return stmt{}, err
+		}
 	}
 
-	r.m.Lock()
-	defer r.m.Unlock()
-
-	if err := r.Work.remove(id); err != nil {
-		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	if a.ExpectRows != nil {
+		if err := a.ExpectRows.validate(); err != nil {
+			return stmt{}, err
+		}
 	}
 
-	x := newXact(ax.Statements)
-	if err := r.Work.add(x); err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+	if a.MaxRows < 0 {
+		return stmt{}, fmt.Errorf("max_rows must be greater than or equal to 0")
 	}
 
-	// Id has changed since statements have changed
-	ax.Id = x.id
-	return c.JSON(http.StatusOK, ax)
-}
+	if a.FetchSize < 0 {
+		return stmt{}, fmt.Errorf("fetch_size must be greater than or equal to 0")
+	}
 
-func removeXact(c echo.Context, r *run) error {
-	id := c.Param("id")
+	if a.FetchSize > 0 && a.Copy != nil {
+		return stmt{}, fmt.Errorf("a copy statement cannot have a fetch_size")
+	}
 
-	r.m.Lock()
-	defer r.m.Unlock()
+	if len(a.Params) > 0 && a.Copy != nil {
+		return stmt{}, fmt.Errorf("a copy statement cannot have params")
+	}
 
-	if err := r.Work.remove(id); err != nil {
-		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	for i, p := range a.Params {
+		if err := p.validate(); err != nil {
+			return stmt{}, fmt.Errorf("invalid param $%d: %w", i+1, err)
+		}
 	}
 
-	return c.JSON(http.StatusOK, struct{}{})
-}
+	s := stmt{Text: a.Sql, Copy: a.Copy, ExpectRows: a.ExpectRows, MaxRows: a.MaxRows, FetchSize: a.FetchSize, Params: a.Params}
 
-func getSchedule(c echo.Context, r *run) error {
-	r.m.RLock()
-	defer r.m.RUnlock()
+	if a.Timeout != "" {
+		t, err := time.ParseDuration(a.Timeout)
+		if err != nil {
+			return stmt{}, fmt.Errorf("invalid timeout: %w", err)
+		}
 
-	return c.JSON(http.StatusOK, scheduleToApiSchedule(r.Schedule))
-}
+		if t <= 0 {
+			return stmt{}, fmt.Errorf("timeout must be positive")
+		}
 
-func updateSchedule(c echo.Context, r *run, ctrl chan struct{}) error {
-	w := apiSchedule{}
-	if err := c.Bind(&w); err != nil {
-		log.Println("could not bind input:", err)
-		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+		s.Timeout = t
 	}
 
-	s, err := apiScheduleToSchedule(w)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	if a.Sleep != "" {
+		if a.Sql != "" || a.Copy != nil || a.ExpectRows != nil || a.FetchSize > 0 || len(a.Params) > 0 {
+			return stmt{}, fmt.Errorf("a sleep statement cannot have sql, copy, expect_rows, fetch_size or params")
+		}
+
+		d, err := time.ParseDuration(a.Sleep)
+		if err != nil {
+			return stmt{}, fmt.Errorf("invalid sleep: %w", err)
+		}
+
+		if d <= 0 {
+			return stmt{}, fmt.Errorf("sleep must be positive")
+		}
+
+		s.Sleep = d
 	}
 
-	r.m.Lock()
-	r.Schedule = s
-	r.m.Unlock()
+	if a.Jitter != "" {
+		if a.Sleep == "" {
+			return stmt{}, fmt.Errorf("jitter is only allowed with sleep")
+		}
 
-	// signal the dispatch that the schedule changed, to make it avoid
-	// check it every loop
-	ctrl <- struct{}{}
+		j, err := time.ParseDuration(a.Jitter)
+		if err != nil {
+			return stmt{}, fmt.Errorf("invalid jitter: %w", err)
+		}
 
-	return c.JSON(http.StatusOK, struct{}{})
-}
+		if j < 0 {
+			return stmt{}, fmt.Errorf("jitter must be greater than or equal to 0")
+		}
 
-func dumpRun(c echo.Context, r *run) error {
-	r.m.RLock()
-	d := apiRun{
-		Schedule: scheduleToApiSchedule(r.Schedule),
-		Work:     runInfoToApiWork(r.Work, true),
+		s.Jitter = j
 	}
 
-	r.m.RUnlock()
-
-	return c.JSON(http.StatusOK, d)
+	return s, nil
 }
 
-func loadRun(c echo.Context, r *run, ctrl chan struct{}) error {
-	nar := apiRun{}
-	if err := c.Bind(&nar); err != nil {
-		log.Println("could not bind input:", err)
-		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+func statsToApiStats(s stats) apiStats {
+	a := apiStats{
+		Interval:       s.Interval.String(),
+		Window:         (time.Duration(s.Window) * s.Interval).String(),
+		Instant:        s.Instant,
+		Average:        s.Average,
+		Failures:       s.Failures,
+		InFlight:       s.InFlight,
+		Queued:         s.Queued,
+		Held:           s.Held,
+		AcquireWaiting: s.AcquireWaiting,
+		ResultsQueue:   s.ResultsQueue,
+		ResultsCap:     s.ResultsCap,
+		SendBlocked:    s.SendBlocked.String(),
+
+		Notifications: s.Notifications,
+		NotifyLatency: s.NotifyLatency.String(),
+
+		RowsCopied: s.RowsCopied,
+
+		AcquireWait:   latenciesToApiLatencies(s.AcquireWait),
+		ExecTime:      latenciesToApiLatencies(s.ExecTime),
+		Connects:      s.Connects,
+		ConnectTime:   latenciesToApiLatencies(s.ConnectTime),
+		AcquireErrors: s.AcquireErrors,
+		NotBegun:      s.NotBegun,
+		ServerTime:    latenciesToApiLatencies(s.ServerTime),
+		FetchTime:     latenciesToApiLatencies(s.FetchTime),
+		TotalTime:     spreadToApiSpread(s.TotalTime),
+
+		BreakerTripped: s.Tripped,
 	}
 
-	s, err := apiScheduleToSchedule(nar.Schedule)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	if !s.StartedAt.IsZero() {
+		a.StartedAt = s.StartedAt.Format(time.RFC3339Nano)
+		a.Uptime = time.Since(s.StartedAt).Truncate(time.Millisecond).String()
 	}
 
-	nr := run{
-		Schedule: s,
-		Work:     apiWorkToRunInfo(nar.Work),
+	return a
+}
+
+func latenciesToApiLatencies(l latencies) apiLatencies {
+	return apiLatencies{
+		P50: l.P50.String(),
+		P95: l.P95.String(),
+		P99: l.P99.String(),
 	}
+}
 
-	// we have to keep the mutex by copying its pointer before replacing
-	// the contents of the run pointer
-	mx := r.m
-	mx.Lock()
-	*r = nr
-	r.m = mx
-	mx.Unlock()
+func failuresToApiFailures(l []failure) []apiFailure {
+	a := make([]apiFailure, 0, len(l))
+	for _, f := range l {
+		a = append(a, apiFailure{
+			XactId:   f.XactId,
+			XactName: f.XactName,
+			Trace:    f.Trace,
+			Time:     f.Time.Format(time.RFC3339Nano),
+			Outcome:  string(f.Outcome),
+			Error:    f.Error,
+			SQLState: f.SQLState,
+		})
+	}
 
-	ctrl <- struct{}{}
+	return a
+}
 
-	return c.JSON(http.StatusOK, r)
+func spreadToApiSpread(s spread) apiSpread {
+	return apiSpread{
+		Min:    s.Min.String(),
+		Max:    s.Max.String(),
+		Mean:   s.Mean.String(),
+		Stddev: s.Stddev.String(),
+	}
 }
 
-// runApi starts the echo web server after linking all api functions to api
-// endpoints
-func runApi(hostPort string, todo *run, ctrl chan struct{}) {
-	e := echo.New()
+func histogramToApiHistogram(h histogram) apiHistogram {
+	a := apiHistogram{
+		Buckets: make([]apiBucket, 0, len(h.Counts)),
+	}
 
-	e.HideBanner = true
-	e.HidePort = true
+	for i, c := range h.Counts {
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = h.Bounds[i].String()
+		}
 
-	// Middleware
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "${time_rfc3339} ${remote_ip} ${latency_human} ${method} ${uri} ${status} ${error}\n",
-	}))
-	e.Use(middleware.Recover())
+		a.Count += c
+		a.Buckets = append(a.Buckets, apiBucket{Le: le, Count: c})
+	}
+
+	return a
+}
 
-	// Routes
-	e.GET("/v1/xacts", func(c echo.Context) error { return getAllXacts(c, todo) })
-	e.POST("/v1/xacts", func(c echo.Context) error { return addXact(c, todo) })
-	e.GET("/v1/xacts/:id", func(c echo.Context) error { return getXact(c, todo) })
-	e.PATCH("/v1/xacts/:id", func(c echo.Context) error { return updateXact(c, todo) }) // append queries
-	e.PUT("/v1/xacts/:id", func(c echo.Context) error { return replaceXact(c, todo) })
-	e.DELETE("/v1/xacts/:id", func(c echo.Context) error { return removeXact(c, todo) })
+func xactCountersToApiXactCounters(c xactCounters) apiXactCounters {
+	return apiXactCounters{
+		Commits:     c.Commits,
+		Rollbacks:   c.Rollbacks,
+		Terminated:  c.Terminated,
+		Held:        c.Held,
+		NotRun:      c.NotRun,
+		MeanLatency: c.mean().String(),
+		LastOutcome: string(c.lastOutcome()),
+	}
+}
 
-	e.GET("/v1/schedule", func(c echo.Context) error { return getSchedule(c, todo) })
-	e.POST("/v1/schedule", func(c echo.Context) error { return updateSchedule(c, todo, ctrl) })
+func xactResultToApiXactRun(r xactResult, err error) apiXactRun {
+	ar := apiXactRun{
+		Id:         r.xactId,
+		Name:       r.xactName,
+		Trace:      r.trace,
+		Outcome:    string(r.outcome),
+		Retries:    r.retries,
+		Statements: make([]apiStmtResult, 0, len(r.stmts)),
+	}
 
-	e.GET("/v1/run", func(c echo.Context) error { return dumpRun(c, todo) })
-	e.POST("/v1/run", func(c echo.Context) error { return loadRun(c, todo, ctrl) })
+	if !r.endTime.IsZero() {
+		ar.Duration = r.endTime.Sub(r.startTime).String()
+	}
 
-	// Start server
-	log.Printf("HTTP REST API listening on %s", hostPort)
-	e.Logger.Fatal(e.Start(hostPort))
-}
+	if !r.acquireTime.IsZero() {
+		ar.Acquire = r.acquireTime.Sub(r.startTime).String()
+	}
 
-func loadRunFromFile(path string) (run, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return run{}, fmt.Errorf("could not load file %s: %w", path, err)
+	if r.connectTime > 0 {
+		ar.Connect = r.connectTime.String()
 	}
 
-	ar := apiRun{}
-	err = json.Unmarshal(data, &ar)
 	if err != nil {
-		return run{}, fmt.Errorf("could not parse JSON from %s: %w", path, err)
+		ar.Error = err.Error()
 	}
 
-	s, err := apiScheduleToSchedule(ar.Schedule)
-	if err != nil {
-		return run{}, fmt.Errorf("could not load schedule from file: %w", err)
+	for _, s := range r.stmts {
+		as := apiStmtResult{
+			Sql:          s.text,
+			Duration:     s.stopTime.Sub(s.startTime).String(),
+			Rows:         s.count,
+			RowsAffected: s.rowsAffected,
+			TimedOut:     s.timedOut,
+			Truncated:    s.truncated,
+			Fetches:      len(s.fetches),
+		}
+
+		if s.serverTime > 0 {
+			as.ServerTime = s.serverTime.String()
+		}
+
+		if s.err != nil {
+			as.Error = s.err.Error()
+		}
+
+		ar.Statements = append(ar.Statements, as)
+	}
+
+	return ar
+}
+
+// API actions: they all get the pointer to the run to edit it, the mutex must
+// be used when reading and writing the run
+
+// getXactErrors lists the SQLSTATE of the errors of a xact, the most frequent
+// first
+func getXactErrors(c echo.Context, r *run, st *stats) error {
+	id := c.Param("id")
+
+	r.m.RLock()
+	_, err := r.Work.get(id)
+	r.m.RUnlock()
+
+	if err != nil {
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	errs := make([]apiXactError, 0)
+	for code, e := range st.errorsOf(id) {
+		errs = append(errs, apiXactError{
+			SQLState: code,
+			Count:    e.Count,
+			LastSeen: e.LastSeen.Format(time.RFC3339Nano),
+		})
+	}
+
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Count != errs[j].Count {
+			return errs[i].Count > errs[j].Count
+		}
+		return errs[i].SQLState < errs[j].SQLState
+	})
+
+	return c.JSON(http.StatusOK, errs)
+}
+
+func getXact(c echo.Context, r *run, st *stats) error {
+	id := c.Param("id")
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	x, err := r.Work.get(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	ax := xactToApiXact(x)
+	counters := xactCountersToApiXactCounters(st.xactCounters(id))
+	ax.Counters = &counters
+
+	return c.JSON(http.StatusOK, ax)
+}
+
+// getXactSource gives the SQL source of a xact as text, the one its id is
+// computed from
+func getXactSource(c echo.Context, r *run) error {
+	id := c.Param("id")
+
+	r.m.RLock()
+	x, err := r.Work.get(id)
+	r.m.RUnlock()
+
+	if err != nil {
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	return c.String(http.StatusOK, x.source+"\n")
+}
+
+func getAllXacts(c echo.Context, r *run) error {
+	switch c.QueryParam("format") {
+	case "", "json":
+	case "ndjson":
+		return streamXacts(c, r)
+	default:
+		return c.JSON(http.StatusBadRequest, apiError{"format must be json or ndjson"})
+	}
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return c.JSON(http.StatusOK, runInfoToApiWork(r.Work, false))
+}
+
+// streamXacts sends the xacts one JSON object per line, in order, so that
+// large runs are not built in memory and clients can read them as they come.
+// The lock is only held to take the list, not while the client reads.
+func streamXacts(c echo.Context, r *run) error {
+	r.m.RLock()
+	xl := r.Work.ordered()
+	r.m.RUnlock()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(res)
+	for i, x := range xl {
+		if err := enc.Encode(xactToApiXact(x)); err != nil {
+			return err
+		}
+
+		if i%100 == 99 {
+			res.Flush()
+		}
+	}
+
+	res.Flush()
+
+	return nil
+}
+
+func addXact(c echo.Context, r *run, ctrl chan struct{}) error {
+	ax := apiXact{}
+	if err := c.Bind(&ax); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	x, err := apiXactToXact(ax, r.variables())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	// With validate, the xact is checked and expanded but not added
+	if c.QueryParam("validate") == "true" {
+		return c.JSON(http.StatusOK, xactToApiXact(x))
+	}
+
+	r.m.Lock()
+	err = r.Work.add(x)
+	r.m.Unlock()
+
+	if err != nil {
+		return c.JSON(http.StatusConflict, apiError{err.Error()})
+	}
+
+	notifyDispatch(ctrl)
+
+	// Answer with what is stored, the outcome is normalized and part of
+	// the id
+	return c.JSON(http.StatusCreated, xactToApiXact(x))
+}
+
+func updateXact(c echo.Context, r *run, ctrl chan struct{}) error {
+	id := c.Param("id")
+
+	ax := apiXact{}
+	if err := c.Bind(&ax); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	x, err := apiXactToXact(ax, r.variables())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	r.m.Lock()
+	cur, err := r.Work.get(id)
+	if err != nil {
+		r.m.Unlock()
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	// The outcome is only changed when given, the payload defaults to
+	// commit otherwise
+	outcome := ax.Outcome != ""
+	if outcome {
+		if err := checkHold(x.Outcome, x.Hold, cur.Autocommit); err != nil {
+			r.m.Unlock()
+			return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+		}
+	}
+
+	newX, err := r.Work.appendXact(id, x, outcome)
+	r.m.Unlock()
+
+	if err != nil {
+		return c.JSON(http.StatusConflict, apiError{err.Error()})
+	}
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, changedXactToApiXact(newX, id))
+}
+
+func replaceXact(c echo.Context, r *run, ctrl chan struct{}) error {
+	id := c.Param("id")
+
+	ax := apiXact{}
+	if err := c.Bind(&ax); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	x, err := apiXactToXact(ax, r.variables())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	r.m.Lock()
+	if _, err := r.Work.get(id); err != nil {
+		r.m.Unlock()
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	err = r.Work.replace(id, x)
+	r.m.Unlock()
+
+	if err != nil {
+		return c.JSON(http.StatusConflict, apiError{err.Error()})
+	}
+
+	notifyDispatch(ctrl)
+
+	// Id has changed since statements or outcome have changed
+	return c.JSON(http.StatusOK, changedXactToApiXact(x, id))
+}
+
+// updateOutcome changes the outcome of a xact, the response gives its new id
+func updateOutcome(c echo.Context, r *run, ctrl chan struct{}) error {
+	id := c.Param("id")
+
+	ao := struct {
+		Outcome string `json:"outcome"`
+		Hold    string `json:"hold"`
+	}{}
+	if err := c.Bind(&ao); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	o, err := parseOutcome(ao.Outcome)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	var hold time.Duration
+	if ao.Hold != "" {
+		hold, err = time.ParseDuration(ao.Hold)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: invalid hold: %s", err)})
+		}
+	}
+
+	r.m.Lock()
+	if _, err := r.Work.get(id); err != nil {
+		r.m.Unlock()
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	x, err := r.Work.setOutcome(id, o, hold)
+	r.m.Unlock()
+
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+	}
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, changedXactToApiXact(x, id))
+}
+
+func removeXact(c echo.Context, r *run, ctrl chan struct{}) error {
+	id := c.Param("id")
+
+	r.m.Lock()
+	err := r.Work.remove(id)
+	r.m.Unlock()
+
+	if err != nil {
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, struct{}{})
+}
+
+// setXactOrder changes the order of the xacts, the payload is the list of
+// all the ids in the new order
+func setXactOrder(c echo.Context, r *run, ctrl chan struct{}) error {
+	ids := make([]string, 0)
+	if err := c.Bind(&ids); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	r.m.Lock()
+	err := r.Work.setOrder(ids)
+	r.m.Unlock()
+
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, ids)
+}
+
+// setXactEnabled includes or excludes a xact from the schedule, its
+// definition is kept
+func setXactEnabled(c echo.Context, r *run, ctrl chan struct{}, enabled bool) error {
+	id := c.Param("id")
+
+	r.m.Lock()
+	x, err := r.Work.get(id)
+	if err != nil {
+		r.m.Unlock()
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	x.Enabled = enabled
+	r.Work.Xacts[id] = x
+	r.m.Unlock()
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, xactToApiXact(x))
+}
+
+// renameXact changes the name of a xact, its id stays the same
+func renameXact(c echo.Context, r *run) error {
+	id := c.Param("id")
+
+	an := struct {
+		Name string `json:"name"`
+	}{}
+	if err := c.Bind(&an); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	r.m.Lock()
+	x, err := r.Work.get(id)
+	if err != nil {
+		r.m.Unlock()
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	x.Name = an.Name
+	r.Work.Xacts[id] = x
+	r.m.Unlock()
+
+	return c.JSON(http.StatusOK, xactToApiXact(x))
+}
+
+// runXactOnce executes a xact of the run a single time, outside of the
+// schedule, and returns the result of each statement. Results are not
+// accounted in the stats of the run.
+func runXactOnce(c echo.Context, rn *runner) error {
+	id := c.Param("id")
+
+	rn.work.m.RLock()
+	x, err := rn.work.Work.get(id)
+	rn.work.m.RUnlock()
+
+	if err != nil {
+		return c.JSON(http.StatusNotFound, apiError{err.Error()})
+	}
+
+	res, err := runXact(c.Request().Context(), x, rn.source())
+
+	return c.JSON(http.StatusOK, xactResultToApiXactRun(res, err))
+}
+
+// runAllOnce executes the enabled xacts of the run a single time, in order,
+// on one connection, apart from the schedule
+func runAllOnce(c echo.Context, rn *runner) error {
+	opts := apiRunOnce{}
+	if err := c.Bind(&opts); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"malformed payload"})
+	}
+
+	results, notRun := runOnce(c.Request().Context(), rn.work, rn.source(), opts.StopOnError)
+
+	a := apiRunOnceResult{
+		Xacts:  make([]apiXactRun, 0, len(results)),
+		NotRun: notRun,
+	}
+
+	for _, r := range results {
+		if r.failed() {
+			a.Failures++
+		}
+
+		a.Xacts = append(a.Xacts, xactResultToApiXactRun(r.res, r.failure()))
+	}
+
+	return c.JSON(http.StatusOK, a)
+}
+
+// dryRunXact executes the xact given in the payload a single time, without
+// adding it to the run
+func dryRunXact(c echo.Context, rn *runner) error {
+	ax := apiXact{}
+	if err := c.Bind(&ax); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	x, err := apiXactToXact(ax, rn.work.variables())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	res, err := runXact(c.Request().Context(), x, rn.source())
+
+	return c.JSON(http.StatusOK, xactResultToApiXactRun(res, err))
+}
+
+// execSql runs a command given in the payload once on a connection of the
+// run, like VACUUM or SELECT pg_stat_reset() between two phases of a test
+func execSql(c echo.Context, rn *runner) error {
+	ae := apiExec{}
+	if err := c.Bind(&ae); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	if ae.Sql == "" {
+		return c.JSON(http.StatusBadRequest, apiError{"malformed payload: missing sql"})
+	}
+
+	res, err := execCommand(c.Request().Context(), ae.Sql, ae.Transaction, rn.source())
+
+	ar := apiExecResult{
+		CommandTag: res.tag,
+		Duration:   res.duration.String(),
+	}
+
+	if err != nil {
+		ar.Error = err.Error()
+	}
+
+	return c.JSON(http.StatusOK, ar)
+}
+
+func getSchedule(c echo.Context, r *run) error {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	s := apiScheduleStatus{apiSchedule: scheduleToApiSchedule(r.Schedule)}
+	if !r.lastChange.time.IsZero() {
+		s.LastChange = &apiScheduleChange{
+			Time:    r.lastChange.time.Format(time.RFC3339Nano),
+			Changes: r.lastChange.changes,
+		}
+	}
+
+	return c.JSON(http.StatusOK, s)
+}
+
+func updateSchedule(c echo.Context, r *run, ctrl chan struct{}) error {
+	w := apiSchedule{}
+	if err := c.Bind(&w); err != nil {
+		log.Println("could not bind input:", err)
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	s, err := apiScheduleToSchedule(w)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	r.m.Lock()
+	r.setSchedule(s)
+	r.m.Unlock()
+
+	// signal the dispatch that the schedule changed, to make it avoid
+	// check it every loop, this does not wait for dispatch
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, struct{}{})
+}
+
+// setFrequency changes only the frequency of the schedule, to sweep it
+// without sending the rest of the schedule
+func setFrequency(c echo.Context, r *run, ctrl chan struct{}) error {
+	af := struct {
+		Frequency string `json:"frequency"`
+	}{}
+	if err := c.Bind(&af); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	f, err := parseFrequency(af.Frequency)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: invalid frequency: %s", err)})
+	}
+
+	r.m.Lock()
+	changed := r.Schedule
+	changed.Frequency = f
+	r.setSchedule(changed)
+	s := scheduleToApiSchedule(r.Schedule)
+	r.m.Unlock()
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, s)
+}
+
+// resumeRun clears the circuit breaker and unpauses the run
+func resumeRun(c echo.Context, rn *runner) error {
+	rn.stats.setTripped(false)
+
+	rn.work.m.Lock()
+	resumed := rn.work.Schedule
+	resumed.Pause = false
+	rn.work.setSchedule(resumed)
+	s := scheduleToApiSchedule(rn.work.Schedule)
+	rn.work.m.Unlock()
+
+	notifyDispatch(rn.ctrl)
+
+	return c.JSON(http.StatusOK, s)
+}
+
+// validateSchedule checks a schedule the same way updateSchedule does but
+// does not apply it
+func validateSchedule(c echo.Context) error {
+	w := apiSchedule{}
+	if err := c.Bind(&w); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	s, err := apiScheduleToSchedule(w)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	return c.JSON(http.StatusOK, scheduleToApiSchedule(s))
+}
+
+func dumpRun(c echo.Context, r *run) error {
+	r.m.RLock()
+	d := apiRun{
+		Schedule: scheduleToApiSchedule(r.Schedule),
+		Work:     runInfoToApiWork(r.Work, true),
+	}
+
+	r.m.RUnlock()
+
+	return c.JSON(http.StatusOK, d)
+}
+
+func loadRun(c echo.Context, r *run, ctrl chan struct{}, st *stats) error {
+	nar := apiRun{}
+	if err := c.Bind(&nar); err != nil {
+		log.Println("could not bind input:", err)
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	s, err := apiScheduleToSchedule(nar.Schedule)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	w, err := apiWorkToRunInfo(nar.Work)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	// Only the contents are replaced, the run keeps its mutex
+	r.m.Lock()
+	r.load(s, w)
+	d := apiRun{
+		Schedule: scheduleToApiSchedule(r.Schedule),
+		Work:     runInfoToApiWork(r.Work, false),
+	}
+	r.m.Unlock()
+
+	// The uptime is the one of the new workload, even when the schedule
+	// stays the same
+	st.restart()
+	notifyDispatch(ctrl)
+
+	// Only the api representation is sent, it has no secrets nor internal
+	// fields
+	return c.JSON(http.StatusOK, d)
+}
+
+// clearRun removes all the xacts and the listeners, pauses the schedule and
+// resets the stats, to start over
+func clearRun(c echo.Context, r *run, ctrl chan struct{}, st *stats) error {
+	r.m.Lock()
+	r.setSchedule(ctrlData{
+		Workers:   1,
+		Frequency: time.Second,
+		Pause:     true,
+	})
+	r.Work = newRunInfo(nil)
+	r.gen++
+	d := apiRun{
+		Schedule: scheduleToApiSchedule(r.Schedule),
+		Work:     runInfoToApiWork(r.Work, false),
+	}
+	r.m.Unlock()
+
+	st.reset()
+	st.restart()
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, d)
+}
+
+// applyRun changes the schedule, removes and adds xacts under a single lock,
+// so that dispatch never sees a part of the changes. Nothing is applied when
+// one of the changes is invalid.
+func applyRun(c echo.Context, r *run, ctrl chan struct{}) error {
+	aa := apiApply{}
+	if err := c.Bind(&aa); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	var s ctrlData
+	if aa.Schedule != nil {
+		var err error
+		s, err = apiScheduleToSchedule(*aa.Schedule)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+		}
+	}
+
+	vars := r.variables()
+	add := make([]xact, 0, len(aa.Add))
+	for _, ax := range aa.Add {
+		x, err := apiXactToXact(ax, vars)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+		}
+		add = append(add, x)
+	}
+
+	r.m.Lock()
+
+	// Check the changes against the current xacts before touching them
+	ids := make(map[string]bool, len(r.Work.Xacts))
+	for id := range r.Work.Xacts {
+		ids[id] = true
+	}
+
+	for _, id := range aa.Remove {
+		if !ids[id] {
+			r.m.Unlock()
+			return c.JSON(http.StatusNotFound, apiError{fmt.Sprintf("xact %s not found in run list", id)})
+		}
+		delete(ids, id)
+	}
+
+	for _, x := range add {
+		if ids[x.id] {
+			r.m.Unlock()
+			return c.JSON(http.StatusConflict, apiError{fmt.Sprintf("xact %s already exists in run list", x.id)})
+		}
+		ids[x.id] = true
+	}
+
+	for _, id := range aa.Remove {
+		r.Work.remove(id)
+	}
+
+	for _, x := range add {
+		r.Work.add(x)
+	}
+
+	if aa.Schedule != nil {
+		r.setSchedule(s)
+	}
+
+	d := apiRun{
+		Schedule: scheduleToApiSchedule(r.Schedule),
+		Work:     runInfoToApiWork(r.Work, false),
+	}
+
+	r.m.Unlock()
+
+	notifyDispatch(ctrl)
+
+	return c.JSON(http.StatusOK, d)
+}
+
+func getStats(c echo.Context, st *stats) error {
+	return c.JSON(http.StatusOK, statsToApiStats(st.snapshot()))
+}
+
+// getFailures gives the last failed xacts, the most recent last
+func getFailures(c echo.Context, st *stats) error {
+	return c.JSON(http.StatusOK, failuresToApiFailures(st.snapshot().RecentFailures))
+}
+
+// getHistogram gives the distribution of the total latency of the xacts since
+// startup or the last reset
+func getHistogram(c echo.Context, st *stats) error {
+	return c.JSON(http.StatusOK, histogramToApiHistogram(st.snapshot().Histogram))
+}
+
+// resetStats forgets the failures, the counters of each xact and the
+// histogram
+func resetStats(c echo.Context, st *stats) error {
+	st.reset()
+
+	return c.JSON(http.StatusOK, struct{}{})
+}
+
+func configToApiConfig(opts *config, poolConfig *pgxpool.Config) apiConfig {
+	origins := opts.corsOrigins
+	if origins == nil {
+		origins = []string{}
+	}
+
+	return apiConfig{
+		ApiListenAddr:     opts.apiListenAddr,
+		MetricsListenAddr: opts.metricsListenAddr,
+		CorsOrigins:       origins,
+		GzipMinSize:       opts.gzipMinSize,
+		AccessLog:         opts.accessLog,
+		Quiet:             opts.quiet,
+		Verbose:           opts.verbose,
+		WorkFile:          opts.workFilePath,
+		StrictWorkFile:    opts.strictWork,
+		WatchWorkFile:     opts.watchWork,
+		DbUrl:             redactConnString(opts.connstring),
+		PasswordFile:      opts.passwordFile,
+		SslMode:           opts.sslMode,
+		SslRootCert:       opts.sslRootCert,
+		SslCert:           opts.sslCert,
+		SslKey:            opts.sslKey,
+		LazyConnect:       opts.lazyConnect,
+		ConnectRetries:    opts.connectRetries,
+		ConnectTimeout:    opts.connectTimeout.String(),
+		NoPool:            opts.noPool,
+		Protocol:          opts.protocol,
+		StatementCache:    opts.stmtCache,
+		Warmup:            opts.warmup,
+		StatsInterval:     opts.statsInterval.String(),
+		StatsWindow:       opts.statsWindow,
+		HistogramSteps:    opts.histSteps,
+		MaxFailures:       opts.maxFailures,
+		MaxInflight:       opts.maxInflight,
+		AcquireWarn:       opts.acquireWarn,
+		TagQueries:        opts.tagQueries,
+		SlowXact:          opts.slowXact.String(),
+		ResultsBuffer:     opts.resultsBuffer,
+		PgbenchLog:        opts.pgbenchLog,
+		Seed:              opts.seed,
+		PgSetseed:         opts.pgSetseed,
+		SampleActivity:    opts.sampleActivity.String(),
+		XactIdHash:        opts.xactIdHash,
+		XactIdLength:      opts.xactIdLength,
+		XactIdNormalize:   opts.xactIdNormalize,
+		Ramp:              opts.rampSpec,
+
+		BreakerThreshold: opts.breakerThreshold,
+		BreakerWindow:    opts.breakerWindow,
+		BreakerExit:      opts.breakerExit,
+
+		MaxFailureRate:    opts.maxFailureRate,
+		MaxFailureWindows: opts.maxFailureWindows,
+
+		Vars: opts.vars,
+
+		Pool: apiPoolConfig{
+			MaxConns:          poolConfig.MaxConns,
+			MinConns:          poolConfig.MinConns,
+			MaxConnLifetime:   poolConfig.MaxConnLifetime.String(),
+			MaxConnIdleTime:   poolConfig.MaxConnIdleTime.String(),
+			HealthCheckPeriod: poolConfig.HealthCheckPeriod.String(),
+		},
+	}
+}
+
+func getConfig(c echo.Context, runs *runnerSet) error {
+	return c.JSON(http.StatusOK, configToApiConfig(runs.opts, runs.poolConfig))
+}
+
+func activityToApiActivity(s activitySample, err error) apiActivity {
+	a := apiActivity{
+		Backends: s.Backends,
+		Blocked:  s.Blocked,
+		Waits:    make([]apiActivityWait, 0, len(s.Waits)),
+	}
+
+	if !s.Time.IsZero() {
+		a.Time = s.Time.Format(time.RFC3339Nano)
+	}
+
+	if err != nil {
+		a.Error = err.Error()
+	}
+
+	for _, w := range s.Waits {
+		a.Waits = append(a.Waits, apiActivityWait{State: w.State, EventType: w.EventType, Event: w.Event, Count: w.Count})
+	}
+
+	return a
+}
+
+// getActivity gives the last sample of the sessions of low-runner, the error
+// of the last attempt is included when it failed
+func getActivity(c echo.Context, activity *activitySampler) error {
+	if activity == nil {
+		return c.JSON(http.StatusNotFound, apiError{"activity sampling is disabled, see --sample-activity"})
+	}
+
+	return c.JSON(http.StatusOK, activityToApiActivity(activity.get()))
+}
+
+// getHealth tells the API is up, for the probes of the monitoring
+func getHealth(c echo.Context) error {
+	return c.JSON(http.StatusOK, apiHealth{Status: "ok"})
+}
+
+func listRuns(c echo.Context, runs *runnerSet) error {
+	l := make([]apiRunInfo, 0)
+
+	for _, name := range runs.names() {
+		rn, err := runs.get(name)
+		if err != nil {
+			continue
+		}
+
+		rn.work.m.RLock()
+		l = append(l, apiRunInfo{Name: name, Schedule: scheduleToApiSchedule(rn.work.Schedule)})
+		rn.work.m.RUnlock()
+	}
+
+	return c.JSON(http.StatusOK, l)
+}
+
+func createRun(c echo.Context, runs *runnerSet) error {
+	name := c.Param("name")
+
+	nar := apiRun{}
+	if err := c.Bind(&nar); err != nil {
+		log.Println("could not bind input:", err)
+		return c.JSON(http.StatusBadRequest, apiError{"missing or malformed payload"})
+	}
+
+	s, err := apiScheduleToSchedule(nar.Schedule)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	w, err := apiWorkToRunInfo(nar.Work)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{fmt.Sprintf("malformed payload: %s", err)})
+	}
+
+	if _, err := runs.get(name); err == nil {
+		return c.JSON(http.StatusConflict, apiError{"run already exists"})
+	}
+
+	nr := newRun(s, w)
+
+	if _, err := runs.create(name, nr); err != nil {
+		return c.JSON(http.StatusInternalServerError, apiError{fmt.Sprintf("could not start run: %s", err)})
+	}
+
+	return c.JSON(http.StatusCreated, apiRun{
+		Schedule: scheduleToApiSchedule(nr.Schedule),
+		Work:     runInfoToApiWork(nr.Work, false),
+	})
+}
+
+// runRoutes links the api functions acting on a run to endpoints of the
+// group, get finds the run the request is about
+func runRoutes(g *echo.Group, get func(c echo.Context) (*runner, error)) {
+	with := func(h func(c echo.Context, rn *runner) error) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rn, err := get(c)
+			if err != nil {
+				return c.JSON(http.StatusNotFound, apiError{err.Error()})
+			}
+
+			return h(c, rn)
+		}
+	}
+
+	g.GET("/xacts", with(func(c echo.Context, rn *runner) error { return getAllXacts(c, rn.work) }))
+	g.POST("/xacts", with(func(c echo.Context, rn *runner) error { return addXact(c, rn.work, rn.ctrl) }))
+	g.PUT("/xacts/order", with(func(c echo.Context, rn *runner) error { return setXactOrder(c, rn.work, rn.ctrl) }))
+	g.GET("/xacts/:id", with(func(c echo.Context, rn *runner) error { return getXact(c, rn.work, rn.stats) }))
+	g.GET("/xacts/:id/errors", with(func(c echo.Context, rn *runner) error { return getXactErrors(c, rn.work, rn.stats) }))
+	g.GET("/xacts/:id/source", with(func(c echo.Context, rn *runner) error { return getXactSource(c, rn.work) }))
+	g.PATCH("/xacts/:id", with(func(c echo.Context, rn *runner) error { return updateXact(c, rn.work, rn.ctrl) })) // append queries
+	g.PATCH("/xacts/:id/outcome", with(func(c echo.Context, rn *runner) error { return updateOutcome(c, rn.work, rn.ctrl) }))
+	g.PUT("/xacts/:id", with(func(c echo.Context, rn *runner) error { return replaceXact(c, rn.work, rn.ctrl) }))
+	g.DELETE("/xacts/:id", with(func(c echo.Context, rn *runner) error { return removeXact(c, rn.work, rn.ctrl) }))
+	g.POST("/xacts/:id/enable", with(func(c echo.Context, rn *runner) error { return setXactEnabled(c, rn.work, rn.ctrl, true) }))
+	g.POST("/xacts/:id/disable", with(func(c echo.Context, rn *runner) error { return setXactEnabled(c, rn.work, rn.ctrl, false) }))
+	g.PUT("/xacts/:id/name", with(func(c echo.Context, rn *runner) error { return renameXact(c, rn.work) }))
+	g.POST("/xacts/:id/run", with(runXactOnce))
+	g.POST("/xacts/run", with(dryRunXact))
+	g.POST("/exec", with(execSql))
+
+	g.GET("/schedule", with(func(c echo.Context, rn *runner) error { return getSchedule(c, rn.work) }))
+	g.POST("/schedule", with(func(c echo.Context, rn *runner) error { return updateSchedule(c, rn.work, rn.ctrl) }))
+	g.POST("/schedule/frequency", with(func(c echo.Context, rn *runner) error { return setFrequency(c, rn.work, rn.ctrl) }))
+	g.POST("/resume", with(resumeRun))
+	g.POST("/schedule/validate", with(func(c echo.Context, rn *runner) error { return validateSchedule(c) }))
+
+	g.GET("/run", with(func(c echo.Context, rn *runner) error { return dumpRun(c, rn.work) }))
+	g.POST("/run", with(func(c echo.Context, rn *runner) error { return loadRun(c, rn.work, rn.ctrl, rn.stats) }))
+	g.POST("/run/once", with(runAllOnce))
+	g.DELETE("/run", with(func(c echo.Context, rn *runner) error { return clearRun(c, rn.work, rn.ctrl, rn.stats) }))
+	g.POST("/apply", with(func(c echo.Context, rn *runner) error { return applyRun(c, rn.work, rn.ctrl) }))
+
+	statsRoutes(g, get)
+	g.POST("/stats/reset", with(func(c echo.Context, rn *runner) error { return resetStats(c, rn.stats) }))
+}
+
+// statsRoutes links the read only routes of the stats of a run, they are
+// also served on the metrics listener
+func statsRoutes(g *echo.Group, get func(c echo.Context) (*runner, error)) {
+	with := func(h func(c echo.Context, st *stats) error) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rn, err := get(c)
+			if err != nil {
+				return c.JSON(http.StatusNotFound, apiError{err.Error()})
+			}
+
+			return h(c, rn.stats)
+		}
+	}
+
+	g.GET("/stats", with(getStats))
+	g.GET("/failures", with(getFailures))
+	g.GET("/stats/histogram", with(getHistogram))
+}
+
+// newEcho creates a web server with the middlewares set from the options
+func newEcho(opts *config) *echo.Echo {
+	e := echo.New()
+
+	e.HideBanner = true
+	e.HidePort = true
+
+	// Middleware: the access log goes to the same output as the other logs
+	switch opts.accessLog {
+	case "text":
+		e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+			Format: "${time_rfc3339} ${remote_ip} ${latency_human} ${method} ${uri} ${status} ${error}\n",
+			Output: log.Writer(),
+		}))
+	case "json":
+		e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+			Format: `{"time":"${time_rfc3339_nano}","remote_ip":"${remote_ip}","method":"${method}","uri":"${uri}",` +
+				`"status":${status},"error":"${error}","latency":${latency},"latency_human":"${latency_human}",` +
+				`"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n",
+			Output: log.Writer(),
+		}))
+	}
+	e.Use(middleware.Recover())
+
+	// CORS headers are only sent when origins are configured
+	if len(opts.corsOrigins) > 0 {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins: opts.corsOrigins,
+			AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowHeaders: []string{echo.HeaderContentType, echo.HeaderAccept},
+		}))
+	}
+
+	if opts.gzipMinSize > 0 {
+		e.Use(gzipMiddleware(opts.gzipMinSize))
+	}
+
+	return e
+}
+
+// serveApi listens on hostPort until ctx is canceled, then stops gracefully
+func serveApi(ctx context.Context, e *echo.Echo, hostPort string) {
+	go func() {
+		<-ctx.Done()
+
+		// Give the requests in flight some time to finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := e.Shutdown(shutdownCtx); err != nil {
+			log.Printf("could not stop the REST API on %s: %s", hostPort, err)
+		}
+	}()
+
+	if err := e.Start(hostPort); err != nil && err != http.ErrServerClosed {
+		e.Logger.Fatal(err)
+	}
+}
+
+// runApi starts the echo web server after linking all api functions to api
+// endpoints, it serves until ctx is canceled. When a metrics listen address is
+// set, the read only routes of the stats are served there too, without the
+// activity that shows the text of the queries.
+func runApi(ctx context.Context, opts *config, runs *runnerSet, activity *activitySampler) {
+	if opts.metricsListenAddr != "" {
+		m := newEcho(opts)
+		m.GET("/v1/health", getHealth)
+		statsRoutes(m.Group("/v1"), func(c echo.Context) (*runner, error) { return runs.get(defaultRunName) })
+		statsRoutes(m.Group("/v1/runs/:name"), func(c echo.Context) (*runner, error) { return runs.get(c.Param("name")) })
+
+		log.Printf("HTTP REST API of the stats listening on %s", opts.metricsListenAddr)
+		go serveApi(ctx, m, opts.metricsListenAddr)
+	}
+
+	e := newEcho(opts)
+
+	// Routes: the routes of the default run are kept at the top of /v1 for
+	// backward compatibility, named runs are under /v1/runs/:name
+	runRoutes(e.Group("/v1"), func(c echo.Context) (*runner, error) { return runs.get(defaultRunName) })
+
+	e.GET("/v1/health", getHealth)
+	e.GET("/v1/config", func(c echo.Context) error { return getConfig(c, runs) })
+	e.GET("/v1/activity", func(c echo.Context) error { return getActivity(c, activity) })
+	e.GET("/v1/runs", func(c echo.Context) error { return listRuns(c, runs) })
+	e.POST("/v1/runs/:name", func(c echo.Context) error { return createRun(c, runs) })
+	runRoutes(e.Group("/v1/runs/:name"), func(c echo.Context) (*runner, error) { return runs.get(c.Param("name")) })
+
+	// Start server
+	log.Printf("HTTP REST API listening on %s", opts.apiListenAddr)
+	serveApi(ctx, e, opts.apiListenAddr)
+}
+
+// loadRunFromFile reads a run from a JSON file, the listen address and the
+// connection string it may have are set in opts unless they were given on
+// the command line or in the environment
+func loadRunFromFile(path string, opts *config) (*run, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load file %s: %w", path, err)
+	}
+
+	ar := apiRun{}
+	err = json.Unmarshal(data, &ar)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse JSON from %s: %w", path, err)
+	}
+
+	// A missing schedule does not prevent loading the xacts, without
+	// workers dispatch starts the run paused until the schedule is updated
+	workers := ar.Schedule.Workers
+	if workers == 0 {
+		ar.Schedule.Workers = 1
+	}
+
+	if ar.Schedule.Frequency == "" {
+		ar.Schedule.Frequency = time.Second.String()
+	}
+
+	s, err := apiScheduleToSchedule(ar.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("could not load schedule from file: %w", err)
+	}
+
+	s.Workers = workers
+
+	w, err := apiWorkToRunInfo(ar.Work)
+	if err != nil {
+		return nil, fmt.Errorf("could not load xacts from file: %w", err)
+	}
+
+	r := newRun(s, w)
+
+	if ar.ApiListenAddr != "" && !opts.explicit["api-listen-addr"] {
+		opts.apiListenAddr = ar.ApiListenAddr
 	}
 
-	r := run{
-		m:        &sync.RWMutex{},
-		Schedule: s,
-		Work:     apiWorkToRunInfo(ar.Work),
+	if ar.DbUrl != "" && !opts.explicit["db-url"] {
+		opts.connstring = ar.DbUrl
 	}
 
 	return r, nil
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestApi serves the routes of a run that has no dispatcher, the signals
+// sent to it are only left in its ctrl channel
+func newTestApi(r *run) *echo.Echo {
+	rn := &runner{
+		name:  defaultRunName,
+		work:  r,
+		ctrl:  make(chan struct{}, 1),
+		stats: newStats(time.Second, 1, 10, 0),
+		m:     &sync.RWMutex{},
+	}
+
+	e := echo.New()
+	runRoutes(e.Group("/v1"), func(c echo.Context) (*runner, error) { return rn, nil })
+
+	return e
+}
+
+func TestLoadRunThenGetXacts(t *testing.T) {
+	e := newTestApi(defaulWork())
+
+	payload := `{"schedule": {"workers": 2, "frequency": "1s"}, "work": {"xacts": [{"statements": ["SELECT 2"]}]}}`
+
+	// Readers run while the run is replaced, none of them must panic or
+	// see a missing run
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/xacts", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("GET /v1/xacts: expected status 200, got %d", rec.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/run", strings.NewReader(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /v1/run: expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/xacts", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "SELECT 2") {
+		t.Fatalf("GET /v1/xacts: expected the xact of the new run, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPatchXactOutcome(t *testing.T) {
+	x := newXact([]string{"SELECT 1"})
+	r := newRun(ctrlData{Workers: 1, Frequency: time.Second}, newRunInfo([]xact{x}))
+	e := newTestApi(r)
+
+	req := httptest.NewRequest(http.MethodPatch, "/v1/xacts/"+x.id, strings.NewReader(`{"statements": ["SELECT 2"], "outcome": "rollback"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /v1/xacts/:id: expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if _, err := r.Work.get(x.id); err == nil {
+		t.Fatal("the id of the xact did not change with its outcome")
+	}
+
+	// PATCH appends the statements given to the ones of the xact
+	expected := []string{"SELECT 1", "SELECT 2"}
+	for _, cur := range r.Work.Xacts {
+		texts := make([]string, 0, len(cur.Statements))
+		for _, st := range cur.Statements {
+			texts = append(texts, st.Text)
+		}
+
+		if !reflect.DeepEqual(texts, expected) {
+			t.Fatalf("expected the statements %q, got %q", expected, texts)
+		}
+
+		if cur.Outcome != Rollback {
+			t.Fatalf("expected the rollback outcome, got %s", cur.Outcome)
+		}
+	}
+}
+
+func TestParseFrequencyRefusesNonPositive(t *testing.T) {
+	for _, s := range []string{"0s", "-1s", "0/s", "-2/m"} {
+		if f, err := parseFrequency(s); err == nil {
+			t.Errorf("expected %s to be refused, got %s", s, f)
+		}
+	}
+
+	if f, err := parseFrequency("500ms"); err != nil || f != 500*time.Millisecond {
+		t.Fatalf("expected 500ms, got %s, %v", f, err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// copyFrom describes a COPY FROM STDIN statement sent with the copy protocol,
+// the rows are either generated or read from a CSV file.
+type copyFrom struct {
+	// Target table, it can be qualified with the schema
+	Table string `json:"table"`
+
+	// Columns to fill, in order
+	Columns []string `json:"columns"`
+
+	// Number of rows to generate and how to generate the value of each
+	// column, see genValue
+	Rows     int      `json:"rows,omitempty"`
+	Generate []string `json:"generate,omitempty"`
+
+	// Path to a CSV file to read the rows from instead of generating them
+	File string `json:"file,omitempty"`
+}
+
+func (c *copyFrom) validate() error {
+	if c.Table == "" {
+		return fmt.Errorf("missing table for copy")
+	}
+
+	if len(c.Columns) == 0 {
+		return fmt.Errorf("missing columns for copy")
+	}
+
+	if c.File != "" {
+		if c.Rows != 0 || len(c.Generate) != 0 {
+			return fmt.Errorf("copy rows are either read from a file or generated")
+		}
+
+		return nil
+	}
+
+	if c.Rows < 1 {
+		return fmt.Errorf("number of rows to copy must be greater than or equal to 1")
+	}
+
+	if len(c.Generate) != len(c.Columns) {
+		return fmt.Errorf("copy needs one generator per column")
+	}
+
+	for _, g := range c.Generate {
+		if _, err := genValue(g, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// text gives the SQL text of the COPY, with the source of the data as a
+// comment so that it is part of the source of the xact
+func (c *copyFrom) text() string {
+	var origin string
+	if c.File != "" {
+		origin = fmt.Sprintf("file=%s", c.File)
+	} else {
+		origin = fmt.Sprintf("rows=%d generate=%s", c.Rows, strings.Join(c.Generate, ","))
+	}
+
+	return fmt.Sprintf("COPY %s (%s) FROM STDIN; -- %s", c.Table, strings.Join(c.Columns, ", "), origin)
+}
+
+func (c *copyFrom) identifier() pgx.Identifier {
+	return pgx.Identifier(strings.Split(c.Table, "."))
+}
+
+// source prepares the rows to send
+func (c *copyFrom) source() (pgx.CopyFromSource, error) {
+	if c.File != "" {
+		records, err := loadCSV(c.File)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := make([][]interface{}, 0, len(records))
+		for i, rec := range records {
+			if len(rec) != len(c.Columns) {
+				return nil, fmt.Errorf("line %d of %s has %d fields, expected %d", i+1, c.File, len(rec), len(c.Columns))
+			}
+
+			row := make([]interface{}, len(rec))
+			for j, v := range rec {
+				row[j] = v
+			}
+			rows = append(rows, row)
+		}
+
+		return pgx.CopyFromRows(rows), nil
+	}
+
+	return &genRows{spec: c}, nil
+}
+
+// genRows generates the rows of a copy on the fly
+type genRows struct {
+	spec *copyFrom
+	n    int
+	err  error
+}
+
+func (g *genRows) Next() bool {
+	if g.err != nil || g.n >= g.spec.Rows {
+		return false
+	}
+
+	g.n++
+	return true
+}
+
+func (g *genRows) Values() ([]interface{}, error) {
+	row := make([]interface{}, len(g.spec.Generate))
+	for i, spec := range g.spec.Generate {
+		v, err := genValue(spec, g.n)
+		if err != nil {
+			g.err = err
+			return nil, err
+		}
+		row[i] = v
+	}
+
+	return row, nil
+}
+
+func (g *genRows) Err() error {
+	return g.err
+}
+
+// genValue computes a value for a column of a generated copy from the spec of
+// the generator:
+//
+//	serial           the number of the row, starting at 1
+//	int[:min:max]    random integer, between 0 and 1000000 by default
+//	float            random float between 0 and 1
+//	text[:len]       random string of letters, 16 by default
+//	now              current time
+//	const:value      the given value as text
+func genValue(spec string, n int) (interface{}, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	args := ""
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+
+	switch parts[0] {
+	case "serial":
+		return int64(n), nil
+	case "int":
+		min, max := int64(0), int64(1000000)
+		if args != "" {
+			bounds := strings.SplitN(args, ":", 2)
+			if len(bounds) != 2 {
+				return nil, fmt.Errorf("invalid bounds in generator %q", spec)
+			}
+
+			var err error
+			if min, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid bounds in generator %q", spec)
+			}
+			if max, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || max < min {
+				return nil, fmt.Errorf("invalid bounds in generator %q", spec)
+			}
+		}
+
+		// The number of values wraps around when the bounds are
+		// too far apart, Int63n would panic on it
+		span := max - min + 1
+		if span <= 0 {
+			return nil, fmt.Errorf("bounds too far apart in generator %q", spec)
+		}
+		return min + rng.Int63n(span), nil
+	case "float":
+		return rng.Float64(), nil
+	case "text":
+		length := 16
+		if args != "" {
+			l, err := strconv.Atoi(args)
+			if err != nil || l < 0 {
+				return nil, fmt.Errorf("invalid length in generator %q", spec)
+			}
+			length = l
+		}
+		return randomText(length), nil
+	case "now":
+		return time.Now(), nil
+	case "const":
+		return args, nil
+	}
+
+	return nil, fmt.Errorf("unknown generator %q", spec)
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func randomText(length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = letters[rng.Intn(len(letters))]
+	}
+
+	return string(b)
+}
+
+// Largest data file loaded in memory
+const maxDataFileSize = 256 << 20
+
+// Data files are loaded once and kept in memory
+var csvCache = struct {
+	m     sync.Mutex
+	files map[string][][]string
+}{files: make(map[string][][]string)}
+
+func loadCSV(path string) ([][]string, error) {
+	csvCache.m.Lock()
+	defer csvCache.m.Unlock()
+
+	if records, ok := csvCache.files[path]; ok {
+		return records, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open data file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("could not read data file %s: %w", path, err)
+	}
+
+	if info.Size() > maxDataFileSize {
+		return nil, fmt.Errorf("data file %s is too large: %d bytes, the maximum is %d", path, info.Size(), maxDataFileSize)
+	}
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not read data file %s: %w", path, err)
+	}
+
+	csvCache.files[path] = records
+
+	return records, nil
+}
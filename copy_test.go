@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCopyRejectsWideIntBounds(t *testing.T) {
+	specs := []string{
+		"int:-9223372036854775808:9223372036854775807",
+		"int:-1:9223372036854775807",
+		"int:10:1",
+	}
+
+	for _, spec := range specs {
+		c := copyFrom{Table: "t", Columns: []string{"a"}, Rows: 1, Generate: []string{spec}}
+		if err := c.validate(); err == nil {
+			t.Errorf("expected %s to be refused", spec)
+		}
+	}
+
+	v, err := genValue("int:0:9223372036854775806", 0)
+	if err != nil {
+		t.Fatalf("expected the widest bounds to be accepted, got %s", err)
+	}
+	if v.(int64) < 0 {
+		t.Fatalf("expected a value between the bounds, got %d", v)
+	}
+}
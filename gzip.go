@@ -0,0 +1,135 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+// gzipResponse compresses the body once it reaches minSize bytes, smaller
+// bodies are sent as is because compressing them is not worth the cost
+type gzipResponse struct {
+	http.ResponseWriter
+	minSize int
+
+	// Status and beginning of the body held until we know the size of the
+	// body is worth compressing
+	status int
+	buf    []byte
+
+	// Set once the decision to compress or not is taken
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipResponse) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *gzipResponse) Write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	if w.decided {
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// decide sends the status and what was held of the body, compressed or not
+func (w *gzipResponse) decide(compress bool) error {
+	w.decided = true
+
+	if compress {
+		w.Header().Set(echo.HeaderContentEncoding, "gzip")
+		w.Header().Del(echo.HeaderContentLength)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+
+	return err
+}
+
+// Flush sends what was written so far, a body still below the minimum size
+// is sent without compression
+func (w *gzipResponse) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends what is left once the handler returned
+func (w *gzipResponse) finish() error {
+	if !w.decided {
+		return w.decide(false)
+	}
+
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+
+	return nil
+}
+
+// gzipMiddleware compresses the responses of at least minSize bytes for the
+// clients accepting gzip
+func gzipMiddleware(minSize int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+			if !strings.Contains(c.Request().Header.Get(echo.HeaderAcceptEncoding), "gzip") {
+				return next(c)
+			}
+
+			rw := res.Writer
+			w := &gzipResponse{ResponseWriter: rw, minSize: minSize}
+			res.Writer = w
+
+			err := next(c)
+
+			// Errors returned by the handler are sent afterwards by echo,
+			// on the original writer
+			res.Writer = rw
+			if ferr := w.finish(); err == nil {
+				err = ferr
+			}
+
+			return err
+		}
+	}
+}
@@ -1,21 +1,91 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/pflag"
+	"io"
 	"log"
 	"os"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var version string = "0.2.2"
 
+// quietLog writes the final summary and the fatal errors, it is kept when
+// the standard logger is discarded by --quiet
+var quietLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// logXacts logs the timing of each xact, it is set once at startup by
+// --verbose
+var logXacts bool
+
 type config struct {
-	apiListenAddr string
-	workFilePath  string
-	connstring    string
-	lazyConnect   bool
+	apiListenAddr     string
+	metricsListenAddr string
+	workFilePath      string
+	strictWork        bool
+	once              bool
+	stopOnError       bool
+	watchWork         bool
+	connstring        string
+	passwordFile      string
+	sslMode           string
+	sslRootCert       string
+	sslCert           string
+	sslKey            string
+	lazyConnect       bool
+	noPool            bool
+	simpleProto       bool
+	protocol          string
+	stmtCache         string
+	warmup            bool
+	statsInterval     time.Duration
+	statsWindow       int
+	histSteps         int
+	maxFailures       int
+	seed              int64
+	pgSetseed         bool
+	resultsBuffer     int
+	pgbenchLog        string
+	maxInflight       int
+	acquireWarn       int
+	tagQueries        bool
+	varArgs           []string
+	vars              map[string]string
+	slowXact          time.Duration
+	corsOrigins       []string
+	gzipMinSize       int
+	accessLog         string
+
+	quiet   bool
+	verbose bool
+
+	sampleActivity time.Duration
+
+	connectRetries int
+	connectTimeout time.Duration
+
+	breakerThreshold float64
+	breakerWindow    int
+	breakerExit      bool
+
+	maxFailureRate    float64
+	maxFailureWindows int
+
+	rampSpec string
+	ramp     *ramp
+
+	xactIdHash      string
+	xactIdLength    int
+	xactIdNormalize string
+
+	// Options given on the command line or in the environment, the work
+	// file cannot override them
+	explicit map[string]bool
 }
 
 func processCli(args []string) config {
@@ -31,13 +101,70 @@ func processCli(args []string) config {
 		pflag.PrintDefaults()
 	}
 
-	pflag.StringVarP(&opts.apiListenAddr, "api-listen-addr", "l", ":1323", "listen address and port of the REST API (LOWRUNNER_API_LISTEN_ADDR)")
+	pflag.StringVarP(&opts.apiListenAddr, "api-listen-addr", "l", ":1323", "listen address and port of the REST API, also --admin-listen-addr (LOWRUNNER_API_LISTEN_ADDR)")
+	pflag.StringVar(&opts.metricsListenAddr, "metrics-listen-addr", "", "listen address and port of the read only REST API, serving only /v1/health and the stats, of each run under /v1/runs/:name too as they hold no query text, none by default (LOWRUNNER_METRICS_LISTEN_ADDR)")
+	pflag.StringSliceVar(&opts.corsOrigins, "cors-origins", nil, "comma separated list of origins allowed to call the REST API from a browser (LOWRUNNER_CORS_ORIGINS)")
+	pflag.IntVar(&opts.gzipMinSize, "gzip-min-size", 1024, "minimum size in bytes of the API responses compressed with gzip, 0 disables compression (LOWRUNNER_GZIP_MIN_SIZE)")
+	pflag.StringVar(&opts.accessLog, "access-log", "text", "format of the access log of the REST API: off, text or json (LOWRUNNER_ACCESS_LOG)")
+	pflag.BoolVarP(&opts.quiet, "quiet", "q", false, "only log the final summary and the fatal errors (LOWRUNNER_QUIET)")
+	pflag.BoolVarP(&opts.verbose, "verbose", "v", false, "also log the timing of each xact (LOWRUNNER_VERBOSE)\n")
 	pflag.StringVarP(&opts.workFilePath, "work-file", "f", "", "path to a JSON file storing xacts to run at startup (LOWRUNNER_WORK_FILE)")
+	pflag.BoolVar(&opts.strictWork, "strict-workfile", false, "exit when the work file cannot be loaded instead of running the default xact (LOWRUNNER_STRICT_WORKFILE)")
+	pflag.BoolVar(&opts.once, "once", false, "run the xacts once, in order, on a single connection, then exit without starting the REST API (LOWRUNNER_ONCE)")
+	pflag.BoolVar(&opts.stopOnError, "stop-on-error", false, "with --once, do not run the xacts after the first one failing (LOWRUNNER_STOP_ON_ERROR)")
+	pflag.BoolVar(&opts.watchWork, "watch-workfile", false, "load the work file again and replace the run when the file changes (LOWRUNNER_WATCH_WORKFILE)")
 	pflag.StringVarP(&opts.connstring, "db-url", "d", "", "connection string to PostgreSQL (LOWRUNNER_DB_URL)")
-	pflag.BoolVar(&opts.lazyConnect, "lazy-connect", false, "do not connect immediately (LOWRUNNER_LAZY_CONNECT)\n")
+	pflag.StringVar(&opts.passwordFile, "db-password-file", "", "path to a file containing the password to PostgreSQL, also --password-file (LOWRUNNER_DB_PASSWORD_FILE)")
+	pflag.StringVar(&opts.sslMode, "sslmode", "", "SSL mode of the connection to PostgreSQL: disable, allow, prefer, require, verify-ca or verify-full (LOWRUNNER_SSLMODE)")
+	pflag.StringVar(&opts.sslRootCert, "sslrootcert", "", "path to the certificates of the authorities checking the certificate of the server (LOWRUNNER_SSLROOTCERT)")
+	pflag.StringVar(&opts.sslCert, "sslcert", "", "path to the client certificate (LOWRUNNER_SSLCERT)")
+	pflag.StringVar(&opts.sslKey, "sslkey", "", "path to the key of the client certificate (LOWRUNNER_SSLKEY)")
+	pflag.BoolVar(&opts.lazyConnect, "lazy-connect", false, "do not connect immediately (LOWRUNNER_LAZY_CONNECT)")
+	pflag.IntVar(&opts.connectRetries, "connect-retries", 0, "number of times the first connection is tried again when it fails (LOWRUNNER_CONNECT_RETRIES)")
+	pflag.DurationVar(&opts.connectTimeout, "connect-timeout", 0, "time to keep trying the first connection, 0 means no limit when retrying (LOWRUNNER_CONNECT_TIMEOUT)")
+	pflag.BoolVar(&opts.noPool, "no-pool", false, "open a new connection for each xact instead of using a pool (LOWRUNNER_NO_POOL)")
+	pflag.StringVar(&opts.protocol, "protocol", "extended", "query protocol used to send the statements: simple or extended (LOWRUNNER_PROTOCOL)")
+	pflag.BoolVar(&opts.simpleProto, "simple-protocol", false, "same as --protocol simple, e.g. behind pgbouncer (LOWRUNNER_SIMPLE_PROTOCOL)")
+	pflag.StringVar(&opts.stmtCache, "statement-cache", "", "how statements are cached on connections: prepare, describe or none, prepare by default (LOWRUNNER_STATEMENT_CACHE)")
+	pflag.BoolVar(&opts.warmup, "warmup", false, "open and use every connection of the pool before running the first xacts (LOWRUNNER_WARMUP)\n")
+	pflag.DurationVar(&opts.statsInterval, "stats-interval", time.Second, "interval between two computations of the stats (LOWRUNNER_STATS_INTERVAL)")
+	pflag.IntVar(&opts.statsWindow, "stats-window", 0, "number of intervals in the average, 0 means one minute (LOWRUNNER_STATS_WINDOW)")
+	pflag.IntVar(&opts.histSteps, "histogram-steps", 9, "number of buckets for each power of ten in the latency histogram (LOWRUNNER_HISTOGRAM_STEPS)")
+	pflag.IntVar(&opts.maxFailures, "max-failures", 100, "number of the last failed xacts kept for the REST API (LOWRUNNER_MAX_FAILURES)")
+	pflag.IntVar(&opts.maxInflight, "max-inflight", 0, "maximum number of xacts in flight in each run, whatever the max_concurrency of its schedule, 0 means no limit (LOWRUNNER_MAX_INFLIGHT)")
+	pflag.IntVar(&opts.acquireWarn, "acquire-warn", 0, "log a warning when at least this number of workers keep waiting for a connection, 0 disables it (LOWRUNNER_ACQUIRE_WARN)")
+	pflag.StringArrayVar(&opts.varArgs, "var", nil, "set a variable referenced as ${KEY} in the statements, as key=value, can be repeated, environment variables can be referenced too (LOWRUNNER_VAR, comma separated)")
+	pflag.BoolVar(&opts.tagQueries, "tag-queries", false, "start the statements with a comment giving the id of the xact and a trace id, shown in pg_stat_activity (LOWRUNNER_TAG_QUERIES)")
+	pflag.DurationVar(&opts.slowXact, "slow-xact", 0, "log the xacts taking at least this time, with their trace id, 0 disables it (LOWRUNNER_SLOW_XACT)")
+	pflag.IntVar(&opts.resultsBuffer, "results-buffer", 1024, "number of results workers can queue before waiting for the stats (LOWRUNNER_RESULTS_BUFFER)")
+	pflag.StringVar(&opts.pgbenchLog, "pgbench-log", "", "prefix of the files where the results of each run are written in the pgbench log format, none by default (LOWRUNNER_PGBENCH_LOG)\n")
+	pflag.StringVar(&opts.rampSpec, "ramp", "", "increase the workers over time, given as start:step:interval:max, e.g. 1:2:30s:20 (LOWRUNNER_RAMP)\n")
+	pflag.DurationVar(&opts.sampleActivity, "sample-activity", 0, "interval between two samples of the sessions in pg_stat_activity, 0 disables it (LOWRUNNER_SAMPLE_ACTIVITY)")
+	pflag.Float64Var(&opts.breakerThreshold, "breaker-threshold", 0, "ratio of failed xacts, between 0 and 1, that pauses the run, 0 disables it (LOWRUNNER_BREAKER_THRESHOLD)")
+	pflag.IntVar(&opts.breakerWindow, "breaker-window", 10, "number of stats intervals the failure ratio is computed on (LOWRUNNER_BREAKER_WINDOW)")
+	pflag.BoolVar(&opts.breakerExit, "breaker-exit", false, "exit with an error instead of pausing when the breaker trips (LOWRUNNER_BREAKER_EXIT)\n")
+	pflag.Float64Var(&opts.maxFailureRate, "max-failure-rate", 0, "ratio of failed xacts of a stats interval, between 0 and 1, above which low-runner stops with an error, 0 disables it (LOWRUNNER_MAX_FAILURE_RATE)")
+	pflag.IntVar(&opts.maxFailureWindows, "max-failure-windows", 1, "number of stats intervals in a row above the max failure rate that stop low-runner (LOWRUNNER_MAX_FAILURE_WINDOWS)\n")
+	pflag.StringVar(&opts.xactIdHash, "xact-id-hash", "sha1", "hash of the source of the xacts giving their id, sha1 or sha256 (LOWRUNNER_XACT_ID_HASH)")
+	pflag.IntVar(&opts.xactIdLength, "xact-id-length", 0, "number of characters of the hash kept in the id of the xacts, 0 keeps all (LOWRUNNER_XACT_ID_LENGTH)")
+	pflag.StringVar(&opts.xactIdNormalize, "xact-id-normalize", "none", "normalization of the source of the xacts before it is hashed: none, whitespace or case (LOWRUNNER_XACT_ID_NORMALIZE)\n")
+	pflag.Int64Var(&opts.seed, "seed", 0, "seed of the client side random generator shared by the workers, 0 means random, the sequence of draws is reproducible but not which xact gets which value when workers run concurrently (LOWRUNNER_SEED)")
+	pflag.BoolVar(&opts.pgSetseed, "pg-setseed", false, "call setseed() on new connections with a value drawn from the seed (LOWRUNNER_PG_SETSEED)\n")
 	pflag.BoolVar(&showHelp, "help", false, "print usage")
 	pflag.BoolVar(&showVersion, "version", false, "print version\n")
 
+	// Aliases of options
+	pflag.CommandLine.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		switch name {
+		case "password-file":
+			name = "db-password-file"
+		case "admin-listen-addr":
+			name = "api-listen-addr"
+		}
+
+		return pflag.NormalizedName(name)
+	})
+
 	pflag.CommandLine.Parse(args)
 
 	if showHelp {
@@ -50,23 +177,104 @@ func processCli(args []string) config {
 		os.Exit(0)
 	}
 
+	opts.explicit = make(map[string]bool)
 	pflag.VisitAll(func(f *pflag.Flag) {
+		envName := "LOWRUNNER_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if f.Changed || os.Getenv(envName) != "" {
+			opts.explicit[f.Name] = true
+		}
+
 		switch f.Name {
 		case "api-listen-addr":
 			envValue := os.Getenv("LOWRUNNER_API_LISTEN_ADDR")
 			if !f.Changed && envValue != "" {
 				opts.apiListenAddr = envValue
 			}
+		case "metrics-listen-addr":
+			envValue := os.Getenv("LOWRUNNER_METRICS_LISTEN_ADDR")
+			if !f.Changed && envValue != "" {
+				opts.metricsListenAddr = envValue
+			}
+		case "cors-origins":
+			envValue := os.Getenv("LOWRUNNER_CORS_ORIGINS")
+			if !f.Changed && envValue != "" {
+				f.Value.Set(envValue)
+			}
+		case "gzip-min-size":
+			envValue := os.Getenv("LOWRUNNER_GZIP_MIN_SIZE")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_GZIP_MIN_SIZE: %s", err)
+				}
+			}
+		case "access-log":
+			envValue := os.Getenv("LOWRUNNER_ACCESS_LOG")
+			if !f.Changed && envValue != "" {
+				opts.accessLog = envValue
+			}
 		case "work-file":
 			envValue := os.Getenv("LOWRUNNER_WORK_FILE")
 			if !f.Changed && envValue != "" {
 				opts.workFilePath = envValue
 			}
+		case "strict-workfile":
+			envValue := os.Getenv("LOWRUNNER_STRICT_WORKFILE")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.strictWork = true
+				}
+			}
+		case "watch-workfile":
+			envValue := os.Getenv("LOWRUNNER_WATCH_WORKFILE")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.watchWork = true
+				}
+			}
 		case "db-url":
 			envValue := os.Getenv("LOWRUNNER_DB_URL")
 			if !f.Changed && envValue != "" {
 				opts.connstring = envValue
 			}
+		case "db-password-file":
+			envValue := os.Getenv("LOWRUNNER_DB_PASSWORD_FILE")
+			if !f.Changed && envValue != "" {
+				opts.passwordFile = envValue
+			}
+		case "sslmode":
+			envValue := os.Getenv("LOWRUNNER_SSLMODE")
+			if !f.Changed && envValue != "" {
+				opts.sslMode = envValue
+			}
+		case "sslrootcert":
+			envValue := os.Getenv("LOWRUNNER_SSLROOTCERT")
+			if !f.Changed && envValue != "" {
+				opts.sslRootCert = envValue
+			}
+		case "sslcert":
+			envValue := os.Getenv("LOWRUNNER_SSLCERT")
+			if !f.Changed && envValue != "" {
+				opts.sslCert = envValue
+			}
+		case "sslkey":
+			envValue := os.Getenv("LOWRUNNER_SSLKEY")
+			if !f.Changed && envValue != "" {
+				opts.sslKey = envValue
+			}
+		case "once":
+			envValue := os.Getenv("LOWRUNNER_ONCE")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.once = true
+				}
+			}
+		case "stop-on-error":
+			envValue := os.Getenv("LOWRUNNER_STOP_ON_ERROR")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.stopOnError = true
+				}
+			}
 		case "lazy-connect":
 			envValue := os.Getenv("LOWRUNNER_LAZY_CONNECT")
 			if !f.Changed && envValue != "" {
@@ -74,36 +282,399 @@ func processCli(args []string) config {
 					opts.lazyConnect = true
 				}
 			}
+		case "connect-retries":
+			envValue := os.Getenv("LOWRUNNER_CONNECT_RETRIES")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_CONNECT_RETRIES: %s", err)
+				}
+			}
+		case "connect-timeout":
+			envValue := os.Getenv("LOWRUNNER_CONNECT_TIMEOUT")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_CONNECT_TIMEOUT: %s", err)
+				}
+			}
+		case "no-pool":
+			envValue := os.Getenv("LOWRUNNER_NO_POOL")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.noPool = true
+				}
+			}
+		case "protocol":
+			envValue := os.Getenv("LOWRUNNER_PROTOCOL")
+			if !f.Changed && envValue != "" {
+				opts.protocol = envValue
+			}
+		case "simple-protocol":
+			envValue := os.Getenv("LOWRUNNER_SIMPLE_PROTOCOL")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.simpleProto = true
+				}
+			}
+		case "statement-cache":
+			envValue := os.Getenv("LOWRUNNER_STATEMENT_CACHE")
+			if !f.Changed && envValue != "" {
+				opts.stmtCache = envValue
+			}
+		case "warmup":
+			envValue := os.Getenv("LOWRUNNER_WARMUP")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.warmup = true
+				}
+			}
+		case "stats-interval":
+			envValue := os.Getenv("LOWRUNNER_STATS_INTERVAL")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_STATS_INTERVAL: %s", err)
+				}
+			}
+		case "stats-window":
+			envValue := os.Getenv("LOWRUNNER_STATS_WINDOW")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_STATS_WINDOW: %s", err)
+				}
+			}
+		case "histogram-steps":
+			envValue := os.Getenv("LOWRUNNER_HISTOGRAM_STEPS")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_HISTOGRAM_STEPS: %s", err)
+				}
+			}
+		case "max-failures":
+			envValue := os.Getenv("LOWRUNNER_MAX_FAILURES")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_MAX_FAILURES: %s", err)
+				}
+			}
+		case "max-inflight":
+			envValue := os.Getenv("LOWRUNNER_MAX_INFLIGHT")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_MAX_INFLIGHT: %s", err)
+				}
+			}
+		case "acquire-warn":
+			envValue := os.Getenv("LOWRUNNER_ACQUIRE_WARN")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_ACQUIRE_WARN: %s", err)
+				}
+			}
+		case "quiet":
+			envValue := os.Getenv("LOWRUNNER_QUIET")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.quiet = true
+				}
+			}
+		case "verbose":
+			envValue := os.Getenv("LOWRUNNER_VERBOSE")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.verbose = true
+				}
+			}
+		case "var":
+			// The variables are given as a comma separated list of
+			// key=value pairs, so a value cannot hold a comma there
+			envValue := os.Getenv("LOWRUNNER_VAR")
+			if !f.Changed && envValue != "" {
+				for _, kv := range strings.Split(envValue, ",") {
+					f.Value.Set(kv)
+				}
+			}
+		case "tag-queries":
+			envValue := os.Getenv("LOWRUNNER_TAG_QUERIES")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.tagQueries = true
+				}
+			}
+		case "slow-xact":
+			envValue := os.Getenv("LOWRUNNER_SLOW_XACT")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_SLOW_XACT: %s", err)
+				}
+			}
+		case "results-buffer":
+			envValue := os.Getenv("LOWRUNNER_RESULTS_BUFFER")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_RESULTS_BUFFER: %s", err)
+				}
+			}
+		case "pgbench-log":
+			envValue := os.Getenv("LOWRUNNER_PGBENCH_LOG")
+			if !f.Changed && envValue != "" {
+				opts.pgbenchLog = envValue
+			}
+		case "ramp":
+			envValue := os.Getenv("LOWRUNNER_RAMP")
+			if !f.Changed && envValue != "" {
+				opts.rampSpec = envValue
+			}
+		case "sample-activity":
+			envValue := os.Getenv("LOWRUNNER_SAMPLE_ACTIVITY")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_SAMPLE_ACTIVITY: %s", err)
+				}
+			}
+		case "breaker-threshold":
+			envValue := os.Getenv("LOWRUNNER_BREAKER_THRESHOLD")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_BREAKER_THRESHOLD: %s", err)
+				}
+			}
+		case "max-failure-rate":
+			envValue := os.Getenv("LOWRUNNER_MAX_FAILURE_RATE")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_MAX_FAILURE_RATE: %s", err)
+				}
+			}
+		case "max-failure-windows":
+			envValue := os.Getenv("LOWRUNNER_MAX_FAILURE_WINDOWS")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_MAX_FAILURE_WINDOWS: %s", err)
+				}
+			}
+		case "breaker-window":
+			envValue := os.Getenv("LOWRUNNER_BREAKER_WINDOW")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_BREAKER_WINDOW: %s", err)
+				}
+			}
+		case "breaker-exit":
+			envValue := os.Getenv("LOWRUNNER_BREAKER_EXIT")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.breakerExit = true
+				}
+			}
+		case "xact-id-hash":
+			envValue := os.Getenv("LOWRUNNER_XACT_ID_HASH")
+			if !f.Changed && envValue != "" {
+				opts.xactIdHash = envValue
+			}
+		case "xact-id-normalize":
+			envValue := os.Getenv("LOWRUNNER_XACT_ID_NORMALIZE")
+			if !f.Changed && envValue != "" {
+				opts.xactIdNormalize = envValue
+			}
+		case "xact-id-length":
+			envValue := os.Getenv("LOWRUNNER_XACT_ID_LENGTH")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_XACT_ID_LENGTH: %s", err)
+				}
+			}
+		case "seed":
+			envValue := os.Getenv("LOWRUNNER_SEED")
+			if !f.Changed && envValue != "" {
+				if err := f.Value.Set(envValue); err != nil {
+					log.Fatalf("invalid value for LOWRUNNER_SEED: %s", err)
+				}
+			}
+		case "pg-setseed":
+			envValue := os.Getenv("LOWRUNNER_PG_SETSEED")
+			if !f.Changed && envValue != "" {
+				if envValue != "no" && envValue != "false" && envValue != "0" {
+					opts.pgSetseed = true
+				}
+			}
 		}
 	})
 
+	// Intervals too small would make gather spend its time computing stats
+	// instead of draining results
+	if opts.statsInterval < 10*time.Millisecond {
+		log.Fatalln("stats interval must be greater than or equal to 10ms")
+	}
+
+	switch opts.sslMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		log.Fatalln("sslmode must be one of disable, allow, prefer, require, verify-ca or verify-full")
+	}
+
+	if opts.connectRetries < 0 {
+		log.Fatalln("connect retries must be greater than or equal to 0")
+	}
+
+	if opts.connectTimeout < 0 {
+		log.Fatalln("connect timeout must be greater than or equal to 0")
+	}
+
+	if opts.gzipMinSize < 0 {
+		log.Fatalln("gzip minimum size must be greater than or equal to 0")
+	}
+
+	switch opts.accessLog {
+	case "off", "text", "json":
+	default:
+		log.Fatalln("access log must be off, text or json")
+	}
+
+	switch opts.stmtCache {
+	case "", "prepare", "describe", "none":
+	default:
+		log.Fatalln("statement cache must be prepare, describe or none")
+	}
+
+	switch opts.protocol {
+	case "simple", "extended":
+	default:
+		log.Fatalln("protocol must be simple or extended")
+	}
+
+	if opts.simpleProto {
+		if opts.explicit["protocol"] && opts.protocol != "simple" {
+			log.Fatalln("--simple-protocol and --protocol extended are mutually exclusive")
+		}
+		opts.protocol = "simple"
+	}
+	opts.simpleProto = opts.protocol == "simple"
+
+	if opts.simpleProto && opts.stmtCache != "" {
+		log.Fatalln("the simple protocol does not use the statement cache, --protocol simple and --statement-cache are mutually exclusive")
+	}
+
+	if opts.statsWindow < 0 {
+		log.Fatalln("stats window must be greater than or equal to 0")
+	}
+
+	if opts.histSteps < 1 || opts.histSteps > 90 {
+		log.Fatalln("histogram steps must be between 1 and 90")
+	}
+
+	if opts.maxFailures < 0 {
+		log.Fatalln("max failures must be greater than or equal to 0")
+	}
+
+	if opts.maxInflight < 0 {
+		log.Fatalln("max in flight must be greater than or equal to 0")
+	}
+
+	if opts.acquireWarn < 0 {
+		log.Fatalln("acquire warning threshold must be greater than or equal to 0")
+	}
+
+	if opts.slowXact < 0 {
+		log.Fatalln("slow xact threshold must be greater than or equal to 0")
+	}
+
+	if opts.stopOnError && !opts.once {
+		log.Fatalln("stopping on error needs --once")
+	}
+
+	if opts.watchWork && opts.workFilePath == "" {
+		log.Fatalln("watching the work file needs a work file")
+	}
+
+	if opts.quiet && opts.verbose {
+		log.Fatalln("quiet and verbose cannot be used together")
+	}
+
+	if opts.resultsBuffer < 0 {
+		log.Fatalln("results buffer must be greater than or equal to 0")
+	}
+
+	if opts.rampSpec != "" {
+		r, err := parseRamp(opts.rampSpec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts.ramp = r
+	}
+
+	if opts.sampleActivity < 0 {
+		log.Fatalln("activity sampling interval must be greater than or equal to 0")
+	}
+
+	if opts.breakerThreshold < 0 || opts.breakerThreshold > 1 {
+		log.Fatalln("breaker threshold must be between 0 and 1")
+	}
+
+	if opts.breakerWindow < 1 {
+		log.Fatalln("breaker window must be greater than or equal to 1")
+	}
+
+	vars, err := parseVars(opts.varArgs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	opts.vars = vars
+
+	if opts.maxFailureRate < 0 || opts.maxFailureRate > 1 {
+		log.Fatalln("max failure rate must be between 0 and 1")
+	}
+
+	if opts.maxFailureWindows < 1 {
+		log.Fatalln("max failure windows must be greater than or equal to 1")
+	}
+
 	return opts
 }
 
-func defaulWork() run {
-	return run{
-		m: &sync.RWMutex{},
-		Schedule: ctrlData{
-			Workers:   1,
-			Frequency: time.Second,
-			Pause:     false,
-		},
-		Work: newRunInfo([]xact{defaultXact()}),
-	}
+func defaulWork() *run {
+	return newRun(ctrlData{
+		Workers:   1,
+		Frequency: time.Second,
+		Pause:     false,
+	}, newRunInfo([]xact{defaultXact()}))
 }
 
 func main() {
 	opts := processCli(os.Args[1:])
 
-	p, err := setupPG(opts.connstring, opts.lazyConnect)
+	// The access log uses the output of the standard logger, it must be
+	// set before the API is created
+	if opts.quiet {
+		log.SetOutput(io.Discard)
+	}
+	logXacts = opts.verbose
+
+	// Without a seed, one is drawn and logged so that the run can be
+	// replayed, it is shown in the config too
+	if opts.seed == 0 {
+		opts.seed = time.Now().UnixNano()
+	}
+	rng.Seed(opts.seed)
+	log.Printf("random seed: %d", opts.seed)
+
+	// The ids are computed when the xacts are created, starting with the
+	// ones of the work file
+	ids, err := newIdScheme(opts.xactIdHash, opts.xactIdLength, opts.xactIdNormalize)
 	if err != nil {
-		log.Fatalln(err)
+		quietLog.Fatalln(err)
 	}
+	xactIds = ids
+	tagQueries = opts.tagQueries
+	cliVars = opts.vars
 
-	var work run
+	// The work file is loaded first as it can give defaults for the
+	// connection and the REST API
+	var work *run
 	if opts.workFilePath != "" {
-		work, err = loadRunFromFile(opts.workFilePath)
+		work, err = loadRunFromFile(opts.workFilePath, &opts)
 		if err != nil {
+			if opts.strictWork {
+				quietLog.Fatalln(err)
+			}
 			log.Println(err)
 			work = defaulWork()
 		}
@@ -111,11 +682,55 @@ func main() {
 		work = defaulWork()
 	}
 
-	control := make(chan struct{})
+	p, err := setupPG(opts)
+	if err != nil {
+		quietLog.Fatalln(err)
+	}
+
+	// Stop gracefully on interrupt: the API stops accepting requests and the
+	// queries in flight are canceled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A single pass runs the xacts of the work in order and exits, without
+	// the schedule nor the REST API
+	if opts.once {
+		status := runOnceAndExit(ctx, work, newConnSource(p, opts.noPool), opts.stopOnError)
+		stop()
+		p.Close()
+		os.Exit(status)
+	}
+
+	// The runs can stop everything the same way when they fail too much
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+
+	runs := newRunnerSet(ctx, p.Config(), &opts, abort)
+	rn, err := runs.start(defaultRunName, p, work)
+	if err != nil {
+		quietLog.Fatalln(err)
+	}
+
+	go adjustWorkers(ctx, rn)
 
-	go dispatch(p, &work, control)
+	if opts.watchWork {
+		go watchWorkFile(ctx, opts.workFilePath, opts, rn)
+	}
 
-	runApi(opts.apiListenAddr, &work, control)
+	var activity *activitySampler
+	if opts.sampleActivity > 0 {
+		activity = &activitySampler{}
+		go sampleActivity(ctx, p.Config().ConnConfig, opts.sampleActivity, activity)
+	}
 
-	p.Close()
+	runApi(ctx, &opts, runs, activity)
+
+	log.Println("shutting down")
+	runs.close()
+
+	if runs.isAborted() {
+		stop()
+		abort()
+		os.Exit(1)
+	}
 }
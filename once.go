@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// onceResult is the result of a xact of a single pass
+type onceResult struct {
+	res xactResult
+	err error
+}
+
+// failed tells if the xact failed, a statement failing in SQL only marks the
+// result as failed, runXact returns no error for it
+func (r onceResult) failed() bool {
+	return r.err != nil || r.res.failed
+}
+
+// failure gives the error that made the xact fail
+func (r onceResult) failure() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return r.res.failure()
+}
+
+// runOnce runs the enabled xacts of the run a single time, in the order of
+// the run, one after another on the same session, for setup or scripted
+// scenarios. With stopOnError, the xacts after the first failure are not run
+// and counted in notRun.
+func runOnce(ctx context.Context, r *run, src connSource, stopOnError bool) (results []onceResult, notRun int) {
+	r.m.RLock()
+	xl := r.Work.ordered()
+	r.m.RUnlock()
+
+	session := &sessionSource{src: src}
+	defer session.close()
+
+	return runSequence(ctx, xl, stopOnError, func(ctx context.Context, x xact) (xactResult, error) {
+		return runXact(ctx, x, session)
+	})
+}
+
+// runSequence runs the enabled xacts of the list one after another with
+// run, see runOnce
+func runSequence(ctx context.Context, xl []xact, stopOnError bool, run func(context.Context, xact) (xactResult, error)) (results []onceResult, notRun int) {
+	results = make([]onceResult, 0, len(xl))
+	stopped := false
+
+	for _, x := range xl {
+		if !x.Enabled {
+			continue
+		}
+
+		if stopped || ctx.Err() != nil {
+			notRun++
+			continue
+		}
+
+		res, err := run(ctx, x)
+		r := onceResult{res: res, err: err}
+		results = append(results, r)
+
+		if stopOnError && r.failed() {
+			stopped = true
+		}
+	}
+
+	return results, notRun
+}
+
+// runOnceAndExit runs the xacts of the work once with --once and gives the
+// exit status
+func runOnceAndExit(ctx context.Context, work *run, src connSource, stopOnError bool) int {
+	return logOnceResults(runOnce(ctx, work, src, stopOnError))
+}
+
+// logOnceResults logs the result of each xact of a single pass and a
+// summary, it gives the exit status: 1 when a xact failed
+func logOnceResults(results []onceResult, notRun int) int {
+	failures := 0
+	for _, r := range results {
+		if r.failed() {
+			failures++
+			log.Printf("run=%s once: xact=%s ERROR: %v", defaultRunName, xactLabel(r.res.xactId, r.res.xactName), r.failure())
+			continue
+		}
+
+		log.Printf("run=%s once: xact=%s outcome=%s total=%s", defaultRunName, xactLabel(r.res.xactId, r.res.xactName),
+			r.res.outcome, r.res.endTime.Sub(r.res.startTime))
+	}
+
+	quietLog.Printf("run=%s once: xacts=%d failures=%d not_run=%d", defaultRunName, len(results), failures, notRun)
+
+	if failures > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunSequenceStopsOnFailingStatement(t *testing.T) {
+	xl := []xact{
+		newXact([]string{"SELECT 1"}),
+		newXact([]string{"SELECT * FROM missing"}),
+		newXact([]string{"SELECT 3"}),
+	}
+
+	ran := make([]string, 0)
+	run := func(ctx context.Context, x xact) (xactResult, error) {
+		ran = append(ran, x.id)
+		res := xactResult{xactId: x.id, outcome: Commit}
+
+		// Like runXact, a statement failing in SQL gives no error, only
+		// a failed result
+		if x.id == xl[1].id {
+			res.outcome = Rollback
+			res.failed = true
+			res.stmts = []stmtResult{{err: errors.New(`relation "missing" does not exist`)}}
+		}
+
+		return res, nil
+	}
+
+	results, notRun := runSequence(context.Background(), xl, true, run)
+
+	if len(ran) != 2 {
+		t.Fatalf("expected the sequence to stop after 2 xacts, ran %d", len(ran))
+	}
+
+	if len(results) != 2 || notRun != 1 {
+		t.Fatalf("expected 2 results and 1 xact not run, got %d and %d", len(results), notRun)
+	}
+
+	if !results[1].failed() || results[1].failure() == nil {
+		t.Fatalf("expected the second xact to be failed with its error")
+	}
+
+	if status := logOnceResults(results, notRun); status != 1 {
+		t.Fatalf("expected exit status 1, got %d", status)
+	}
+}
+
+func TestRunSequenceGoesOnWithoutStopOnError(t *testing.T) {
+	xl := []xact{
+		newXact([]string{"SELECT 1"}),
+		newXact([]string{"SELECT 2"}),
+	}
+
+	disabled := newXact([]string{"SELECT 3"})
+	disabled.Enabled = false
+	xl = append(xl, disabled)
+
+	run := func(ctx context.Context, x xact) (xactResult, error) {
+		return xactResult{xactId: x.id, failed: x.id == xl[0].id}, nil
+	}
+
+	results, notRun := runSequence(context.Background(), xl, false, run)
+
+	if len(results) != 2 || notRun != 0 {
+		t.Fatalf("expected 2 results and no xact not run, got %d and %d", len(results), notRun)
+	}
+
+	if status := logOnceResults(results, notRun); status != 1 {
+		t.Fatalf("expected exit status 1, got %d", status)
+	}
+
+	if status := logOnceResults(results[1:], notRun); status != 0 {
+		t.Fatalf("expected exit status 0, got %d", status)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// param is the value bound to a $n placeholder of a statement, drawn each
+// time the statement runs: either generated, like the columns of a generated
+// copy, or sampled from a column of a CSV data file, to only use keys that
+// exist.
+type param struct {
+	// Generator of the value, see genValue
+	Generate string `json:"generate,omitempty"`
+
+	// Path to a CSV file and index of the column, starting at 0, to pick
+	// the value from a random line
+	Source string `json:"source,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+// validate checks the spec of the parameter, the data file is loaded to
+// check it has the column, it stays in memory for the executions
+func (p param) validate() error {
+	if (p.Generate == "") == (p.Source == "") {
+		return fmt.Errorf("a param is either generated or read from a source file")
+	}
+
+	if p.Generate != "" {
+		if p.Column != 0 {
+			return fmt.Errorf("column is only allowed with a source file")
+		}
+
+		// The number of the row only exists in a copy, a param would
+		// always be bound to 0
+		if strings.SplitN(p.Generate, ":", 2)[0] == "serial" {
+			return fmt.Errorf("the serial generator is only allowed in a copy")
+		}
+
+		_, err := genValue(p.Generate, 0)
+		return err
+	}
+
+	if p.Column < 0 {
+		return fmt.Errorf("column must be greater than or equal to 0")
+	}
+
+	records, err := loadCSV(p.Source)
+	if err != nil {
+		return err
+	}
+
+	// The CSV reader checks that all the lines have as many fields as the
+	// first one
+	if len(records) == 0 {
+		return fmt.Errorf("data file %s is empty", p.Source)
+	}
+
+	if p.Column >= len(records[0]) {
+		return fmt.Errorf("data file %s has %d columns, column %d does not exist", p.Source, len(records[0]), p.Column)
+	}
+
+	return nil
+}
+
+// value draws a value for the parameter, data files are already in the
+// cache once the param is validated
+func (p param) value() (interface{}, error) {
+	if p.Generate != "" {
+		return genValue(p.Generate, 0)
+	}
+
+	records, err := loadCSV(p.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	return records[rng.Intn(len(records))][p.Column], nil
+}
+
+func (p param) String() string {
+	if p.Generate != "" {
+		return p.Generate
+	}
+
+	return fmt.Sprintf("%s:%d", p.Source, p.Column)
+}
+
+// drawParams gives the arguments of a statement, in the order of the
+// placeholders
+func drawParams(params []param) ([]interface{}, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, 0, len(params))
+	for i, p := range params {
+		v, err := p.value()
+		if err != nil {
+			return nil, fmt.Errorf("could not draw a value for $%d: %w", i+1, err)
+		}
+		args = append(args, v)
+	}
+
+	return args, nil
+}
+
+// paramsText describes the params in the source of the xact
+func paramsText(params []param) string {
+	specs := make([]string, 0, len(params))
+	for _, p := range params {
+		specs = append(specs, p.String())
+	}
+
+	return strings.Join(specs, ",")
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParamRejectsSerial(t *testing.T) {
+	if err := (param{Generate: "serial"}).validate(); err == nil {
+		t.Fatal("expected the serial generator to be refused for a param")
+	}
+
+	if err := (param{Generate: "int:1:10"}).validate(); err != nil {
+		t.Fatalf("expected the int generator to be accepted for a param, got %s", err)
+	}
+}
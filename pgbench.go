@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+)
+
+// pgbenchLog writes the results of the xacts to a file in the format of the
+// per transaction log of pgbench, so that its tooling can read them:
+//
+//	client_id transaction_no time script_no time_epoch time_us
+//
+// The client is the worker slot of the round, time is the latency in
+// microseconds or "failed", and each xact gets a script number in the order
+// they are first seen. Only gather writes to it.
+type pgbenchLog struct {
+	name string
+	f    *os.File
+	w    *bufio.Writer
+
+	// Number of xacts of each client and number of each xact
+	xacts   map[int]int64
+	scripts map[string]int
+}
+
+// openPgbenchLog creates the log of a run, named after the prefix and the
+// name of the run, like pgbench_log.main. There is no log when the prefix is
+// empty.
+func openPgbenchLog(prefix string, name string) (*pgbenchLog, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+
+	path := fmt.Sprintf("%s.%s", prefix, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open pgbench log: %w", err)
+	}
+
+	log.Printf("run=%s writing the results in pgbench format to %s", name, path)
+
+	return &pgbenchLog{
+		name:    name,
+		f:       f,
+		w:       bufio.NewWriter(f),
+		xacts:   make(map[int]int64),
+		scripts: make(map[string]int),
+	}, nil
+}
+
+func (l *pgbenchLog) record(r xactResult) {
+	script, ok := l.scripts[r.xactId]
+	if !ok {
+		script = len(l.scripts)
+		l.scripts[r.xactId] = script
+		log.Printf("run=%s pgbench log: script %d is xact %s", l.name, script, xactLabel(r.xactId, r.xactName))
+	}
+
+	// The xact may have failed before it could begin
+	end := r.endTime
+	if end.IsZero() {
+		end = r.startTime
+	}
+
+	latency := "failed"
+	if !r.failed {
+		latency = fmt.Sprintf("%d", r.endTime.Sub(r.startTime).Microseconds())
+	}
+
+	fmt.Fprintf(l.w, "%d %d %s %d %d %d\n", r.client, l.xacts[r.client], latency, script, end.Unix(), end.Nanosecond()/1000)
+	l.xacts[r.client]++
+}
+
+// flush writes the buffered lines to the file, errors are only logged so
+// that the stats go on
+func (l *pgbenchLog) flush() {
+	if err := l.w.Flush(); err != nil {
+		log.Printf("run=%s ERROR: could not write pgbench log: %s", l.name, err)
+	}
+}
+
+// close writes what is left and closes the file, once the run is done
+func (l *pgbenchLog) close() {
+	l.flush()
+
+	if err := l.f.Close(); err != nil {
+		log.Printf("run=%s ERROR: could not close pgbench log: %s", l.name, err)
+	}
+}
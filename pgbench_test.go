@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPgbenchLogWrittenWhenGatherEnds(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "pgbench_log")
+	plog, err := openPgbenchLog(prefix, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No tick comes during the test, the lines are only written when
+	// gather ends
+	st := newStats(time.Hour, 1, 10, 0)
+	results := make(chan xactResult, 10)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		results <- xactResult{xactId: "x", outcome: Commit, startTime: start, beginTime: start, endTime: start.Add(time.Millisecond)}
+	}
+	close(results)
+
+	gather("test", results, st, newBreaker(0, 1, make(chan struct{}, 1)), newAcquireWatch(0), newFailureWatch(0, 1, func() {}), []resultSink{plog})
+
+	data, err := os.ReadFile(prefix + ".test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Fatalf("expected 3 lines in the pgbench log, got %d", lines)
+	}
+}
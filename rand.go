@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rng is the source for every random choice made on the client side, it is
+// seeded once at startup from --seed so that a run can be replayed. It is
+// safe for concurrent use by the workers, which share it: the order of their
+// draws, so the values each xact gets, depends on the scheduling.
+var rng = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
+
+// lockedSource protects a rand.Source with a mutex, the sources from
+// math/rand are not safe for concurrent use
+type lockedSource struct {
+	m   sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.src.Seed(seed)
+}
+
+// serverSeed returns a value for setseed() in PostgreSQL, which must be
+// between -1 and 1, drawn from rng
+func serverSeed() float64 {
+	return rng.Float64()*2 - 1
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timelineEntry is a xact to run at some offset from the start of the
+// timeline
+type timelineEntry struct {
+	offset time.Duration
+	xactId string
+}
+
+// loadTimeline reads a timeline file: each line gives the time a xact
+// arrived and its id, separated by spaces or a comma. The time is either
+// RFC 3339 or a number of seconds, like an epoch. Empty lines and lines
+// starting with # are ignored, entries going back in time are logged and
+// skipped. The offsets are relative to the first entry.
+func loadTimeline(path string) ([]timelineEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open timeline: %w", err)
+	}
+	defer f.Close()
+
+	entries := make([]timelineEntry, 0)
+	var first, last time.Time
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) != 2 {
+			log.Printf("timeline %s:%d: skipping malformed entry, expected a time and a xact id", path, n)
+			continue
+		}
+
+		t, err := parseTimelineTime(fields[0])
+		if err != nil {
+			log.Printf("timeline %s:%d: skipping entry: %s", path, n, err)
+			continue
+		}
+
+		if len(entries) == 0 {
+			first = t
+		} else if t.Before(last) {
+			log.Printf("timeline %s:%d: skipping entry out of order", path, n)
+			continue
+		}
+		last = t
+
+		entries = append(entries, timelineEntry{offset: t.Sub(first), xactId: fields[1]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read timeline: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("timeline %s has no entries", path)
+	}
+
+	return entries, nil
+}
+
+func parseTimelineTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+
+	return t, nil
+}
+
+// replayer fires the xacts of a timeline at their offset, in a loop, until
+// it is stopped
+type replayer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startReplay runs the timeline on its own goroutine, the xacts are looked
+// up in the run when they are due, so that changes in the run apply. After
+// the last entry, the timeline starts over once pause has elapsed.
+func startReplay(ctx context.Context, rn *runner, timeline []timelineEntry, pause time.Duration, src connSource, sem chan struct{}, results chan xactResult) *replayer {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &replayer{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		// The workers have their own wait group, as this goroutine adds
+		// to it while dispatch may be waiting on its own
+		wg := &sync.WaitGroup{}
+		defer close(r.done)
+		defer wg.Wait()
+
+		t := time.NewTimer(0)
+		defer t.Stop()
+		<-t.C
+
+		start := time.Now()
+		for client := 0; ; {
+			for _, e := range timeline {
+				t.Reset(time.Until(start.Add(e.offset)))
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					return
+				}
+
+				rn.work.m.RLock()
+				x, err := rn.work.Work.get(e.xactId)
+				rn.work.m.RUnlock()
+
+				if err != nil {
+					log.Printf("run=%s timeline: skipping xact %s: %s", rn.name, e.xactId, err)
+					continue
+				}
+
+				if !x.Enabled {
+					continue
+				}
+
+				wg.Add(1)
+				go worker(ctx, src, client, []xact{x}, wg, sem, results, rn.stats)
+				client++
+			}
+
+			start = start.Add(timeline[len(timeline)-1].offset + pause)
+		}
+	}()
+
+	return r
+}
+
+// stop cancels the xacts in flight and waits for the replay to end
+func (r *replayer) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// loadRunTimeline loads the timeline of the schedule of a run, errors are
+// logged and nothing is replayed until the timeline changes
+func loadRunTimeline(name string, path string) []timelineEntry {
+	if path == "" {
+		return nil
+	}
+
+	timeline, err := loadTimeline(path)
+	if err != nil {
+		log.Printf("run=%s ERROR: %s", name, err)
+		return nil
+	}
+
+	log.Printf("run=%s loaded %d entries from timeline %s", name, len(timeline), path)
+
+	return timeline
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,16 +17,165 @@ type run struct {
 	m        *sync.RWMutex
 	Schedule ctrlData `json:"schedule"`
 	Work     runInfo  `json:"work"`
+
+	// Incremented each time the whole run is replaced, dispatch then drains
+	// the xacts in flight of the previous run before starting the new one
+	gen uint64
+
+	// Last change of the schedule made from the API
+	lastChange scheduleChange
+}
+
+// variables gives the variables of the run, to expand the xacts before
+// taking the lock to add them
+func (r *run) variables() map[string]string {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return r.Work.Vars
+}
+
+// scheduleChange tells when the schedule changed and what changed
+type scheduleChange struct {
+	time    time.Time
+	changes string
+}
+
+// setSchedule replaces the schedule and records what changed, the caller
+// must hold the lock
+func (r *run) setSchedule(s ctrlData) {
+	r.lastChange = scheduleChange{
+		time:    time.Now(),
+		changes: scheduleDiff(r.Schedule, s),
+	}
+	r.Schedule = s
+}
+
+// load replaces the schedule and the xacts, the run keeps its mutex and
+// dispatch drains the xacts of the previous run. It must be called with the
+// lock held.
+func (r *run) load(s ctrlData, w runInfo) {
+	r.setSchedule(s)
+	r.Work = w
+	r.gen++
+}
+
+// scheduleDiff describes the changes between two schedules, like "workers
+// 4→8, frequency 1s→500ms"
+func scheduleDiff(old ctrlData, new ctrlData) string {
+	changes := make([]string, 0)
+
+	if old.Workers != new.Workers {
+		changes = append(changes, fmt.Sprintf("workers %d→%d", old.Workers, new.Workers))
+	}
+
+	if old.Frequency != new.Frequency {
+		changes = append(changes, fmt.Sprintf("frequency %s→%s", old.Frequency, new.Frequency))
+	}
+
+	if old.Pause != new.Pause {
+		changes = append(changes, fmt.Sprintf("pause %v→%v", old.Pause, new.Pause))
+	}
+
+	if old.MaxConcurrency != new.MaxConcurrency {
+		changes = append(changes, fmt.Sprintf("max_concurrency %d→%d", old.MaxConcurrency, new.MaxConcurrency))
+	}
+
+	if old.Ordered != new.Ordered {
+		changes = append(changes, fmt.Sprintf("ordered %v→%v", old.Ordered, new.Ordered))
+	}
+
+	if old.Timeline != new.Timeline {
+		changes = append(changes, fmt.Sprintf("timeline %q→%q", old.Timeline, new.Timeline))
+	}
+
+	if len(changes) == 0 {
+		return "none"
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// newRun creates a run ready to be shared, its mutex is never nil and must not
+// be replaced
+func newRun(s ctrlData, w runInfo) *run {
+	return &run{
+		m:        &sync.RWMutex{},
+		Schedule: s,
+		Work:     w,
+	}
 }
 
 type ctrlData struct {
 	Workers   int
 	Frequency time.Duration
 	Pause     bool
+
+	// Maximum number of workers running at the same time across all xacts,
+	// 0 means no limit
+	MaxConcurrency int
+
+	// Each worker runs all the xacts one after another, in the order of the
+	// run, instead of having workers for each xact
+	Ordered bool
+
+	// Path to a timeline file giving when to run the xacts, replacing the
+	// workers and the frequency, see loadTimeline
+	Timeline string
+}
+
+// ramp increases the number of workers over time, to find the point where
+// the database saturates
+type ramp struct {
+	Start    int
+	Step     int
+	Interval time.Duration
+	Max      int
+}
+
+// parseRamp reads a ramp given as start:step:interval:max, for example
+// 1:2:30s:20 starts with 1 worker and adds 2 every 30 seconds up to 20
+func parseRamp(spec string) (*ramp, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("ramp must be given as start:step:interval:max")
+	}
+
+	r := &ramp{}
+	var err error
+
+	if r.Start, err = strconv.Atoi(parts[0]); err != nil || r.Start < 1 {
+		return nil, fmt.Errorf("ramp start must be an integer greater than or equal to 1")
+	}
+
+	if r.Step, err = strconv.Atoi(parts[1]); err != nil || r.Step < 1 {
+		return nil, fmt.Errorf("ramp step must be an integer greater than or equal to 1")
+	}
+
+	if r.Interval, err = time.ParseDuration(parts[2]); err != nil || r.Interval <= 0 {
+		return nil, fmt.Errorf("ramp interval must be a positive duration")
+	}
+
+	if r.Max, err = strconv.Atoi(parts[3]); err != nil || r.Max < r.Start {
+		return nil, fmt.Errorf("ramp max must be an integer greater than or equal to start")
+	}
+
+	return r, nil
 }
 
 type runInfo struct {
 	Xacts map[string]xact
+
+	// Ids of the xacts in the order they were added or the one set from
+	// the API, the ordered schedule runs the xacts in this order
+	Order []string
+
+	// Channels to LISTEN to on dedicated connections
+	Listen []string
+
+	// Variables of the run, the statements of the xacts added later are
+	// expanded with them
+	Vars map[string]string
 }
 
 func newRunInfo(xactList []xact) runInfo {
@@ -30,12 +184,58 @@ func newRunInfo(xactList []xact) runInfo {
 	}
 
 	for _, x := range xactList {
+		if _, ko := r.Xacts[x.id]; !ko {
+			r.Order = append(r.Order, x.id)
+		}
 		r.Xacts[x.id] = x
 	}
 
 	return r
 }
 
+// ordered returns the xacts in order
+func (r runInfo) ordered() []xact {
+	l := make([]xact, 0, len(r.Order))
+	for _, id := range r.Order {
+		l = append(l, r.Xacts[id])
+	}
+
+	return l
+}
+
+// setOrder changes the order of the xacts, every xact must be given once
+func (r *runInfo) setOrder(ids []string) error {
+	if len(ids) != len(r.Xacts) {
+		return fmt.Errorf("the order must have the %d xacts of the run list", len(r.Xacts))
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := r.Xacts[id]; !ok {
+			return fmt.Errorf("xact %s not found in run list", id)
+		}
+
+		if seen[id] {
+			return fmt.Errorf("xact %s is given more than once", id)
+		}
+		seen[id] = true
+	}
+
+	r.Order = append([]string{}, ids...)
+
+	return nil
+}
+
+// renameInOrder keeps the position of a xact whose id changed
+func (r *runInfo) renameInOrder(old string, new string) {
+	for i, id := range r.Order {
+		if id == old {
+			r.Order[i] = new
+			return
+		}
+	}
+}
+
 func (r runInfo) get(xid string) (xact, error) {
 	x, ok := r.Xacts[xid]
 	if !ok {
@@ -45,18 +245,24 @@ func (r runInfo) get(xid string) (xact, error) {
 	return x, nil
 }
 
-func (r runInfo) add(x xact) error {
-	_, ko := r.Xacts[x.id]
+func (r *runInfo) add(x xact) error {
+	cur, ko := r.Xacts[x.id]
 	if ko {
+		// With truncated ids, a different xact can get the same id
+		if !xactIds.sameSource(cur.source, x.source) {
+			return fmt.Errorf("xact id collides with a different xact in run list, use a longer --xact-id-length")
+		}
+
 		return fmt.Errorf("xact already exists in run list")
 	}
 
 	r.Xacts[x.id] = x
+	r.Order = append(r.Order, x.id)
 
 	return nil
 }
 
-func (r runInfo) remove(xid string) error {
+func (r *runInfo) remove(xid string) error {
 	_, ok := r.Xacts[xid]
 	if !ok {
 		return fmt.Errorf("xact not found in run list")
@@ -64,10 +270,19 @@ func (r runInfo) remove(xid string) error {
 
 	delete(r.Xacts, xid)
 
+	for i, id := range r.Order {
+		if id == xid {
+			r.Order = append(r.Order[:i:i], r.Order[i+1:]...)
+			break
+		}
+	}
+
 	return nil
 }
 
-func (r runInfo) appendXact(xid string, x xact) (xact, error) {
+// appendXact adds the statements of x to a xact. With outcome, the outcome
+// and hold of x replace the ones of the xact too.
+func (r *runInfo) appendXact(xid string, x xact, outcome bool) (xact, error) {
 	cur, ok := r.Xacts[xid]
 	if !ok {
 		return xact{}, fmt.Errorf("xact not found in run list")
@@ -77,58 +292,524 @@ func (r runInfo) appendXact(xid string, x xact) (xact, error) {
 		cur.Statements = append(cur.Statements, s)
 	}
 
-	// When the list of statements is changed, the source and id of the
-	// xact must be updated
+	// The multiplier is only changed when given, it does not change the id
+	if x.WorkerMultiplier > 0 {
+		cur.WorkerMultiplier = x.WorkerMultiplier
+	}
+
+	if outcome {
+		cur.Outcome = x.Outcome
+		cur.Hold = x.Hold
+	}
+
+	// When the list of statements or the outcome is changed, the source
+	// and id of the xact must be updated
 	cur.genSource()
 
+	if _, ko := r.Xacts[cur.id]; ko && cur.id != xid {
+		return xact{}, fmt.Errorf("xact already exists in run list")
+	}
+
 	// As the id changes, the old key must be removed and a new one created
 	delete(r.Xacts, xid)
 	r.Xacts[cur.id] = cur
+	r.renameInOrder(xid, cur.id)
 
 	return cur, nil
 }
 
+// replace puts x in place of a xact, at the same place in the order. The xact
+// is kept when x collides with another one.
+func (r *runInfo) replace(xid string, x xact) error {
+	if _, ok := r.Xacts[xid]; !ok {
+		return fmt.Errorf("xact not found in run list")
+	}
+
+	if cur, ko := r.Xacts[x.id]; ko && x.id != xid {
+		if !xactIds.sameSource(cur.source, x.source) {
+			return fmt.Errorf("xact id collides with a different xact in run list, use a longer --xact-id-length")
+		}
+
+		return fmt.Errorf("xact already exists in run list")
+	}
+
+	delete(r.Xacts, xid)
+	r.Xacts[x.id] = x
+	r.renameInOrder(xid, x.id)
+
+	return nil
+}
+
+// setOutcome changes the expected outcome of a xact, keeping its statements
+func (r *runInfo) setOutcome(xid string, o xactOutcome, hold time.Duration) (xact, error) {
+	cur, ok := r.Xacts[xid]
+	if !ok {
+		return xact{}, fmt.Errorf("xact not found in run list")
+	}
+
+	if err := checkHold(o, hold, cur.Autocommit); err != nil {
+		return xact{}, err
+	}
+
+	cur.Outcome = o
+	cur.Hold = hold
+	cur.genSource()
+
+	// The outcome is part of the source so the id changes, unless the xact
+	// runs in autocommit
+	if cur.id != xid {
+		if _, ko := r.Xacts[cur.id]; ko {
+			return xact{}, fmt.Errorf("xact already exists in run list")
+		}
+
+		delete(r.Xacts, xid)
+		r.renameInOrder(xid, cur.id)
+	}
+
+	r.Xacts[cur.id] = cur
+
+	return cur, nil
+}
+
+// Name of the run created at startup, which is the one used by the routes
+// outside of /v1/runs
+const defaultRunName = "main"
+
+// runner ties a run to its dispatch loop: the dispatcher is told about
+// changes in the run on ctrl, with notifyDispatch, and computes its own stats
+type runner struct {
+	name  string
+	work  *run
+	ctrl  chan struct{}
+	stats *stats
+	opts  *config
+
+	// The dispatcher stops, canceling the queries in flight, when the
+	// context is done
+	ctx context.Context
+
+	// Signaled by gather when the circuit breaker trips
+	trip chan struct{}
+
+	// Called by gather to stop low-runner when the run fails too much
+	abort func()
+
+	// The pool is replaced by the dispatcher when its size changes, others
+	// must get it with the mutex
+	m    *sync.RWMutex
+	pool *pgxpool.Pool
+}
+
+// notifyDispatch tells the dispatcher to read the run again without waiting
+// for it, as it may be busy with a round of workers. Dispatch reads the whole
+// run on each signal, so a signal already pending covers the new changes.
+func notifyDispatch(ctrl chan struct{}) {
+	select {
+	case ctrl <- struct{}{}:
+	default:
+	}
+}
+
+func (rn *runner) getPool() *pgxpool.Pool {
+	rn.m.RLock()
+	defer rn.m.RUnlock()
+
+	return rn.pool
+}
+
+func (rn *runner) setPool(pool *pgxpool.Pool) {
+	rn.m.Lock()
+	rn.pool = pool
+	rn.m.Unlock()
+}
+
+// source gives where the xacts of the run get their connection from, with
+// --no-pool a new connection is opened for each xact
+func (rn *runner) source() connSource {
+	return newConnSource(rn.getPool(), rn.opts.noPool)
+}
+
+// newConnSource gives the connections of the pool, or new connections
+// configured like the ones of the pool when noPool is set
+func newConnSource(pool *pgxpool.Pool, noPool bool) connSource {
+	if noPool {
+		config := pool.Config()
+		return connectSource{config: config.ConnConfig, afterConnect: config.AfterConnect}
+	}
+
+	return poolSource{pool: pool}
+}
+
+// runnerSet is the collection of named runs executing in the process, each
+// one with its own connection pool
+type runnerSet struct {
+	m    *sync.RWMutex
+	runs map[string]*runner
+
+	// Every run stops when the context is done, the wait group tracks the
+	// dispatchers
+	ctx context.Context
+	wg  *sync.WaitGroup
+
+	// Configuration used to create the pool of new runs
+	poolConfig *pgxpool.Config
+
+	opts *config
+
+	// Cancels the context of the set to stop low-runner with an error, set
+	// to 1 in aborted
+	cancel  context.CancelFunc
+	aborted int32
+}
+
+func newRunnerSet(ctx context.Context, poolConfig *pgxpool.Config, opts *config, cancel context.CancelFunc) *runnerSet {
+	return &runnerSet{
+		m:          &sync.RWMutex{},
+		runs:       make(map[string]*runner),
+		ctx:        ctx,
+		wg:         &sync.WaitGroup{},
+		poolConfig: poolConfig,
+		opts:       opts,
+		cancel:     cancel,
+	}
+}
+
+// abort stops all the runs and low-runner, which then exits with an error
+func (rs *runnerSet) abort() {
+	atomic.StoreInt32(&rs.aborted, 1)
+	rs.cancel()
+}
+
+func (rs *runnerSet) isAborted() bool {
+	return atomic.LoadInt32(&rs.aborted) == 1
+}
+
+func (rs *runnerSet) get(name string) (*runner, error) {
+	rs.m.RLock()
+	defer rs.m.RUnlock()
+
+	rn, ok := rs.runs[name]
+	if !ok {
+		return nil, fmt.Errorf("run not found")
+	}
+
+	return rn, nil
+}
+
+func (rs *runnerSet) names() []string {
+	rs.m.RLock()
+	defer rs.m.RUnlock()
+
+	names := make([]string, 0, len(rs.runs))
+	for k := range rs.runs {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// start registers a new run and launches its dispatcher on the given pool
+func (rs *runnerSet) start(name string, pool *pgxpool.Pool, todo *run) (*runner, error) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	if _, ko := rs.runs[name]; ko {
+		return nil, fmt.Errorf("run already exists")
+	}
+
+	rn := &runner{
+		name:  name,
+		work:  todo,
+		ctrl:  make(chan struct{}, 1),
+		stats: newStats(rs.opts.statsInterval, rs.opts.statsWindow, rs.opts.histSteps, rs.opts.maxFailures),
+		opts:  rs.opts,
+		ctx:   rs.ctx,
+		trip:  make(chan struct{}, 1),
+		abort: rs.abort,
+		m:     &sync.RWMutex{},
+		pool:  pool,
+	}
+
+	rs.runs[name] = rn
+
+	rs.wg.Add(1)
+	go func() {
+		dispatch(rn)
+		rs.wg.Done()
+	}()
+
+	return rn, nil
+}
+
+// create opens a new pool for the run before starting it
+func (rs *runnerSet) create(name string, todo *run) (*runner, error) {
+	if _, err := rs.get(name); err == nil {
+		return nil, fmt.Errorf("run already exists")
+	}
+
+	pool, err := pgxpool.ConnectConfig(rs.ctx, rs.poolConfig.Copy())
+	if err != nil {
+		return nil, redactError(err, rs.poolConfig.ConnString(), rs.poolConfig.ConnConfig.Password)
+	}
+
+	rn, err := rs.start(name, pool, todo)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return rn, nil
+}
+
+// close waits for the dispatchers to stop, once the context of the set is
+// done, a dispatcher returns after its last results are gathered. It then
+// logs the summary of the runs and closes their pools
+func (rs *runnerSet) close() {
+	rs.wg.Wait()
+
+	for _, name := range rs.names() {
+		rn, err := rs.get(name)
+		if err != nil {
+			continue
+		}
+
+		rn.summary()
+		rn.getPool().Close()
+	}
+}
+
+// summary logs the schedule and the xacts of the run along with their
+// counters, so that the results can be tied to the configuration that
+// produced them
+func (rn *runner) summary() {
+	rn.work.m.RLock()
+	s := rn.work.Schedule
+	ids := make([]string, 0, len(rn.work.Work.Xacts))
+	names := make(map[string]string, len(rn.work.Work.Xacts))
+	for id, x := range rn.work.Work.Xacts {
+		ids = append(ids, id)
+		names[id] = x.Name
+	}
+	rn.work.m.RUnlock()
+
+	sort.Strings(ids)
+
+	ramp := "none"
+	if rn.opts.ramp != nil {
+		ramp = rn.opts.rampSpec
+	}
+
+	st := rn.stats.snapshot()
+
+	// One line with the totals, like the one of pgbench, easy to parse to
+	// compare runs
+	total := xactCounters{}
+	for _, c := range st.Xacts {
+		total.merge(c)
+	}
+
+	xacts := total.runs()
+	duration := time.Since(st.CountersSince)
+	tps := float64(xacts) / duration.Seconds()
+
+	// Without the time spent opening connections, the xacts would have
+	// taken that much less time
+	tpsNoConnect := tps
+	if busy := total.TotalTime - total.ConnectTime; busy > 0 {
+		tpsNoConnect = tps * float64(total.TotalTime) / float64(busy)
+	}
+
+	quietLog.Printf("run=%s final: xacts=%d failures=%d duration=%s tps=%.2f tps_without_connect=%.2f latency_mean=%s latency_p95=%s", rn.name,
+		xacts, st.Failures, duration.Truncate(time.Millisecond), tps, tpsNoConnect, total.mean(), st.Histogram.percentile(95))
+
+	quietLog.Printf("run=%s summary: workers=%d frequency=%s pause=%v max_concurrency=%d ramp=%s uptime=%s failures=%d", rn.name,
+		s.Workers, s.Frequency, s.Pause, s.MaxConcurrency, ramp, time.Since(st.StartedAt).Truncate(time.Millisecond), st.Failures)
+
+	for _, id := range ids {
+		c := st.Xacts[id]
+		quietLog.Printf("run=%s summary: xact=%s commits=%d rollbacks=%d terminated=%d held=%d not_run=%d mean=%s", rn.name, xactLabel(id, names[id]), c.Commits, c.Rollbacks, c.Terminated, c.Held, c.NotRun, c.mean())
+	}
+}
+
+// sinks creates the outputs of the results of the run configured from the
+// options, a sink that cannot be created is left out
+func (rn *runner) sinks() []resultSink {
+	sinks := make([]resultSink, 0)
+
+	plog, err := openPgbenchLog(rn.opts.pgbenchLog, rn.name)
+	if err != nil {
+		log.Printf("run=%s ERROR: %s", rn.name, err)
+	} else if plog != nil {
+		sinks = append(sinks, plog)
+	}
+
+	if rn.opts.slowXact > 0 {
+		sinks = append(sinks, slowLog{name: rn.name, threshold: rn.opts.slowXact})
+	}
+
+	return sinks
+}
+
 // Keep a list of xact to run on the workers and schedule runs
-func dispatch(pool *pgxpool.Pool, todo *run, ctrl chan struct{}) {
+func dispatch(rn *runner) {
+	todo := rn.work
+	ctrl := rn.ctrl
+	pool := rn.getPool()
+	src := rn.source()
+
+	// Without workers, the run waits paused for a schedule update instead
+	// of doing nothing
+	todo.m.Lock()
+	if todo.Schedule.Workers < 1 {
+		log.Printf("run=%s WARNING: invalid number of workers %d, starting paused with 1 worker until the schedule is updated", rn.name, todo.Schedule.Workers)
+		todo.Schedule.Workers = 1
+		todo.Schedule.Pause = true
+	}
+
 	numWorker := todo.Schedule.Workers
-	if numWorker < 1 {
-		log.Println("bad param for dispatch, workers:", numWorker)
-		return
+	frequency := todo.Schedule.Frequency
+	pause := todo.Schedule.Pause
+	maxConcurrency := todo.Schedule.MaxConcurrency
+	ordered := todo.Schedule.Ordered
+	timelinePath := todo.Schedule.Timeline
+	gen := todo.gen
+
+	// With a ramp, the workers of the schedule are replaced by the ones of
+	// the ramp as it goes
+	var rampTick <-chan time.Time
+	if rn.opts.ramp != nil {
+		numWorker = rn.opts.ramp.Start
+		todo.Schedule.Workers = numWorker
+
+		t := time.NewTicker(rn.opts.ramp.Interval)
+		defer t.Stop()
+		rampTick = t.C
 	}
+	todo.m.Unlock()
 
-	log.Println("Starting xact dispatcher")
+	log.Printf("Starting xact dispatcher for run %s", rn.name)
+	rn.stats.restart()
 
-	frequency := todo.Schedule.Frequency
-	pause := false
+	if rn.opts.warmup {
+		pool = warmup(rn, pool, numWorker)
+		src = rn.source()
+	}
+
+	// Results are buffered so that workers do not wait for gather to
+	// consume them, which would add to the time they take
+	res := make(chan xactResult, rn.opts.resultsBuffer)
 
-	res := make(chan xactResult)
-	wg := &sync.WaitGroup{}
-	done := make(chan struct{})
+	// Each launch has its own wait group, so that a launch can start while
+	// the end of a previous one is still being waited for. all tracks the
+	// launches not done yet, to drain them.
+	all := &sync.WaitGroup{}
 	tick := time.NewTicker(frequency)
+	defer tick.Stop()
+
+	// Gather ends once the results channel is closed, after all the
+	// workers are done, so that the summary has the last results
+	gathered := make(chan struct{})
+	go func() {
+		gather(rn.name, res, rn.stats, newBreaker(rn.opts.breakerThreshold, rn.opts.breakerWindow, rn.trip), newAcquireWatch(rn.opts.acquireWarn),
+			newFailureWatch(rn.opts.maxFailureRate, rn.opts.maxFailureWindows, rn.abort), rn.sinks())
+		close(gathered)
+	}()
+
+	// Workers get a context canceled on pause or when the run stops, so
+	// that the queries in flight do not keep running
+	ctx, cancel := context.WithCancel(rn.ctx)
+
+	// Workers take a slot in the semaphore while they run a xact
+	sem := newSemaphore(concurrencyCap(maxConcurrency, rn.opts.maxInflight))
 
-	go gather(res)
+	// With a timeline, the xacts are fired by the replayer instead of the
+	// ticks, it is stopped on changes and started again from the top of
+	// the loop
+	timeline := loadRunTimeline(rn.name, timelinePath)
+	var replay *replayer
+	stopReplay := func() {
+		if replay != nil {
+			replay.stop()
+			replay = nil
+		}
+	}
+	defer stopReplay()
+
+	// Listeners run on their own connections, outside of the schedule
+	listeners := make(map[string]context.CancelFunc)
+	todo.m.RLock()
+	updateListeners(rn.ctx, listeners, todo.Work.Listen, pool, rn.stats)
+	todo.m.RUnlock()
 
 	for {
-		// launch workers
-		if !pause {
+		// launch workers, each launch gets its own done channel so that
+		// the signal of workers canceled by a pause is not taken for the
+		// one of the next launch. It stays nil when nothing is launched.
+		var done chan struct{}
+		launched := 0
+		wg := &sync.WaitGroup{}
+
+		// The replay ends by itself when its context is canceled
+		if replay != nil {
+			select {
+			case <-replay.done:
+				replay = nil
+			default:
+			}
+		}
+
+		if !pause && timelinePath != "" {
+			if replay == nil && timeline != nil {
+				log.Printf("run=%s replaying timeline %s", rn.name, timelinePath)
+				replay = startReplay(ctx, rn, timeline, frequency, src, sem, res)
+			}
+		} else if !pause {
 			todo.m.RLock()
-			for _, v := range todo.Work.Xacts {
-				for i := 0; i < numWorker; i++ {
-					go worker(pool, v, wg, res)
+			if ordered {
+				jobs := make([]xact, 0, len(todo.Work.Order))
+				for _, v := range todo.Work.ordered() {
+					if v.Enabled {
+						jobs = append(jobs, v)
+					}
+				}
+
+				for i := 0; i < numWorker && len(jobs) > 0; i++ {
+					wg.Add(1)
+					go worker(ctx, src, launched, jobs, wg, sem, res, rn.stats)
+					launched++
+				}
+			} else {
+				for _, v := range todo.Work.Xacts {
+					if !v.Enabled {
+						continue
+					}
+
+					for i := 0; i < numWorker*v.workers(); i++ {
+						wg.Add(1)
+						go worker(ctx, src, launched, []xact{v}, wg, sem, res, rn.stats)
+						launched++
+					}
 				}
 			}
 			todo.m.RUnlock()
 
-			go func(c chan struct{}) {
-				wg.Wait()
-				c <- struct{}{}
-			}(done)
-
+			if launched > 0 {
+				done = make(chan struct{}, 1)
+				all.Add(1)
+				go func(wg *sync.WaitGroup, c chan struct{}) {
+					wg.Wait()
+					all.Done()
+					c <- struct{}{}
+				}(wg, done)
+			}
 		}
 
 		// use a flag to keep waiting if the workers have finished before the
-		// ticker
-		waitNextTick := true
+		// ticker, when paused or without xacts to run there is nothing to
+		// wait for and the loop sleeps until the next tick
+		waitNextTick := launched > 0
 	out:
 		for {
 			select {
@@ -142,96 +823,316 @@ func dispatch(pool *pgxpool.Pool, todo *run, ctrl chan struct{}) {
 					break out
 				}
 
+			case <-rn.trip:
+				// Stop everything gracefully, low-runner then exits
+				// with an error
+				if rn.opts.breakerExit {
+					quietLog.Printf("run=%s exiting on too many failures", rn.name)
+					rn.abort()
+					continue
+				}
+
+				// Pause until the run is resumed from the API
+				todo.m.Lock()
+				todo.Schedule.Pause = true
+				todo.m.Unlock()
+
+				if !pause {
+					pause = true
+					cancel()
+					ctx, cancel = context.WithCancel(rn.ctx)
+				}
+
+			case <-rampTick:
+				if numWorker >= rn.opts.ramp.Max {
+					log.Printf("run=%s ramp done with %d workers", rn.name, numWorker)
+					rampTick = nil
+					continue
+				}
+
+				numWorker += rn.opts.ramp.Step
+				if numWorker > rn.opts.ramp.Max {
+					numWorker = rn.opts.ramp.Max
+				}
+
+				log.Printf("run=%s ramp: will spawn %d workers from now on", rn.name, numWorker)
+
+				todo.m.Lock()
+				todo.Schedule.Workers = numWorker
+				todo.m.Unlock()
+
+				if p := resizePool(rn, pool, numWorker); p != pool {
+					pool = p
+					src = rn.source()
+					stopReplay()
+				}
+
+			case <-rn.ctx.Done():
+				log.Printf("run=%s stopping xact dispatcher", rn.name)
+				cancel()
+				stopReplay()
+				all.Wait()
+
+				// Nothing sends results anymore
+				close(res)
+				<-gathered
+				return
+
 			case <-ctrl:
-				// process change in schedule
+				// process change in schedule, the workload starts again
+				// when something changed
 				todo.m.RLock()
+				changed := numWorker != todo.Schedule.Workers ||
+					frequency != todo.Schedule.Frequency ||
+					pause != todo.Schedule.Pause ||
+					maxConcurrency != todo.Schedule.MaxConcurrency ||
+					ordered != todo.Schedule.Ordered ||
+					timelinePath != todo.Schedule.Timeline
+
 				if numWorker != todo.Schedule.Workers {
-					log.Printf("will spawn %d workers from now on", todo.Schedule.Workers)
+					log.Printf("run=%s will spawn %d workers from now on", rn.name, todo.Schedule.Workers)
 					numWorker = todo.Schedule.Workers
 
-					if pool.Config().MaxConns != int32(numWorker) {
-						log.Println("reconnecting to adapt pool size")
-						var err error
-						pool, err = updatePoolConfig(pool, numWorker)
-						if err != nil {
-							log.Println(err)
-						}
+					if p := resizePool(rn, pool, numWorker); p != pool {
+						pool = p
+						src = rn.source()
+					}
+				}
+
+				if maxConcurrency != todo.Schedule.MaxConcurrency {
+					// Workers already launched keep the previous
+					// semaphore
+					maxConcurrency = todo.Schedule.MaxConcurrency
+					size := concurrencyCap(maxConcurrency, rn.opts.maxInflight)
+					sem = newSemaphore(size)
+
+					if size > 0 {
+						log.Printf("run=%s will run at most %d workers at the same time from now on", rn.name, size)
+					} else {
+						log.Printf("run=%s will run all its workers at the same time from now on", rn.name)
 					}
 				}
 
+				if ordered != todo.Schedule.Ordered {
+					log.Printf("run=%s ordered is now: %v", rn.name, todo.Schedule.Ordered)
+					ordered = todo.Schedule.Ordered
+				}
+
+				if timelinePath != todo.Schedule.Timeline {
+					timelinePath = todo.Schedule.Timeline
+					timeline = loadRunTimeline(rn.name, timelinePath)
+				}
+
 				if frequency != todo.Schedule.Frequency {
-					log.Printf("will schedule run every %s from now on", todo.Schedule.Frequency)
+					log.Printf("run=%s will schedule run every %s from now on", rn.name, todo.Schedule.Frequency)
 
 					frequency = todo.Schedule.Frequency
 					tick.Reset(frequency)
 				}
 
 				if pause != todo.Schedule.Pause {
-					log.Printf("pause is now: %v", todo.Schedule.Pause)
+					log.Printf("run=%s pause is now: %v", rn.name, todo.Schedule.Pause)
 					pause = todo.Schedule.Pause
+
+					if pause {
+						// Cancel the xacts in flight, the next ones
+						// get a new context
+						cancel()
+						ctx, cancel = context.WithCancel(rn.ctx)
+					}
 				}
+
+				updateListeners(rn.ctx, listeners, todo.Work.Listen, pool, rn.stats)
+				replaced := gen != todo.gen
+				gen = todo.gen
 				todo.m.RUnlock()
+
+				if changed {
+					rn.stats.restart()
+
+					// The replay uses the schedule it was started
+					// with, start it over
+					stopReplay()
+				}
+
+				// When a new run is loaded, the xacts of the previous
+				// one must not run along with the new ones: cancel and
+				// wait for them before starting over
+				if replaced {
+					log.Printf("run=%s new run loaded, draining the xacts in flight", rn.name)
+					cancel()
+					stopReplay()
+					all.Wait()
+					ctx, cancel = context.WithCancel(rn.ctx)
+
+					if !pause {
+						break out
+					}
+				}
+
+				// The signal also comes when xacts are changed, when
+				// nothing runs, launch the workers now instead of
+				// waiting for the next tick
+				if launched == 0 && !pause {
+					break out
+				}
 			}
 		}
 
 	}
 }
 
-// Get a xact to run, run it and send the result
-func worker(pool *pgxpool.Pool, job xact, wg *sync.WaitGroup, results chan xactResult) {
-	wg.Add(1)
-	r, err := runXact(job, pool)
+// resizePool gives a new pool sized for the number of workers, when the size
+// of the current one does not match
+func resizePool(rn *runner, pool *pgxpool.Pool, numWorker int) *pgxpool.Pool {
+	// Without pooling, connections are not taken from the pool so its size
+	// does not matter
+	if rn.opts.noPool || pool.Config().MaxConns == int32(numWorker) {
+		return pool
+	}
+
+	log.Println("reconnecting to adapt pool size")
+	newPool, err := updatePoolConfig(pool, numWorker)
 	if err != nil {
-		log.Printf("xact run failed: %s", err)
+		log.Printf("run=%s ERROR: could not resize the pool, keeping the current one: %s", rn.name, err)
+		return pool
 	}
+	rn.setPool(newPool)
 
-	results <- r
+	return newPool
+}
+
+// warmup sizes the pool for the workers and establishes all its connections
+// before the first xacts run, it returns the pool to use from now on
+func warmup(rn *runner, pool *pgxpool.Pool, numWorker int) *pgxpool.Pool {
+	if rn.opts.noPool {
+		log.Printf("run=%s no warmup without pool", rn.name)
+		return pool
+	}
 
-	wg.Done()
+	if pool.Config().MaxConns != int32(numWorker) {
+		newPool, err := updatePoolConfig(pool, numWorker)
+		if err != nil {
+			log.Printf("run=%s could not size the pool for warmup: %s", rn.name, err)
+			return pool
+		}
+
+		pool = newPool
+		rn.setPool(pool)
+	}
+
+	start := time.Now()
+	n, err := warmupPool(rn.ctx, pool)
+	if err != nil {
+		log.Printf("run=%s warmup failed after %d connections: %s", rn.name, n, err)
+		return pool
+	}
+
+	log.Printf("run=%s warmed up %d connections in %s", rn.name, n, time.Since(start))
+
+	return pool
 }
 
-// Gather the results from workers and compute stats
-func gather(results chan xactResult) {
-	count := 0
-	tick := time.NewTicker(time.Second)
-	xacts := make([]int, 0)
+// updateListeners starts a listener for the channels not yet listened to and
+// stops the ones not in the list anymore, they all stop when ctx is done
+func updateListeners(ctx context.Context, listeners map[string]context.CancelFunc, channels []string, pool *pgxpool.Pool, st *stats) {
+	wanted := make(map[string]bool)
+	for _, ch := range channels {
+		wanted[ch] = true
 
-	failures := make([]xactResult, 0)
+		if _, ok := listeners[ch]; ok {
+			continue
+		}
 
-	for {
+		log.Printf("listening on channel %s", ch)
+		lctx, cancel := context.WithCancel(ctx)
+		listeners[ch] = cancel
+		go listen(lctx, pool.Config().ConnConfig, ch, st)
+	}
 
-	out:
-		for {
-			select {
-			case res := <-results:
-				// log.Printf("xact=%s total=%v, pg=%v\n", res.xactId, res.endTime.Sub(res.startTime), res.endTime.Sub(res.beginTime))
-				if res.outcome == Rollback {
-					failures = append(failures, res)
-				} else {
-					count++
-				}
+	for ch, cancel := range listeners {
+		if !wanted[ch] {
+			log.Printf("stop listening on channel %s", ch)
+			cancel()
+			delete(listeners, ch)
+		}
+	}
+}
 
-				select {
-				case <-tick.C:
-					break out
-				default:
-				}
-			case <-tick.C:
-				break out
-			}
+// concurrencyCap gives the number of xacts a run can have in flight: the
+// max_concurrency of the schedule bounded by --max-inflight, 0 means no limit
+func concurrencyCap(maxConcurrency int, maxInflight int) int {
+	if maxInflight > 0 && (maxConcurrency < 1 || maxConcurrency > maxInflight) {
+		return maxInflight
+	}
+
+	return maxConcurrency
+}
+
+// newSemaphore creates a semaphore with size slots, there is no semaphore
+// when size is 0
+func newSemaphore(size int) chan struct{} {
+	if size < 1 {
+		return nil
+	}
+
+	return make(chan struct{}, size)
+}
+
+// worker runs the xacts one after another and sends their results, it stops
+// when ctx is done. The caller adds the worker to the wait group before
+// starting it, client is its slot in the round.
+func worker(ctx context.Context, src connSource, client int, jobs []xact, wg *sync.WaitGroup, sem chan struct{}, results chan xactResult, st *stats) {
+	defer wg.Done()
+
+	for _, job := range jobs {
+		if !runJob(ctx, src, client, job, sem, results, st) {
+			return
 		}
+	}
+}
 
-		xacts = append(xacts, count)
-		sum := 0.0
-		for _, v := range xacts {
-			sum += float64(v)
+// runJob gets a slot in the semaphore, runs the xact and sends its result,
+// it returns false when ctx is done
+func runJob(ctx context.Context, src connSource, client int, job xact, sem chan struct{}, results chan xactResult, st *stats) bool {
+	if sem != nil {
+		st.enterQueue()
+		select {
+		case sem <- struct{}{}:
+			st.leaveQueue()
+		case <-ctx.Done():
+			st.leaveQueue()
+			return false
 		}
+		defer func() { <-sem }()
+	}
+
+	st.enterXact()
+	r, err := runXact(withLiveCounters(ctx, st.live), job, src)
+	st.leaveXact()
+	r.err = err
+	r.client = client
 
-		log.Printf("instant xacts/s=%d, 1m avg xacts/s=%.2f, failures=%d\n", count, sum/float64(len(xacts)), len(failures))
-		count = 0
+	// A xact interrupted by a pause or the end of the run did not fail on
+	// the PostgreSQL side, it is not accounted
+	if ctx.Err() != nil {
+		return false
+	}
 
-		if len(xacts) >= 60 {
-			xacts = xacts[1:]
+	// Errors on the connection are told apart from the ones of the xact
+	if err != nil {
+		if r.beginTime.IsZero() {
+			log.Printf("xact=%s could not begin: %s", job.label(), err)
+		} else {
+			log.Printf("xact=%s run failed: %s", job.label(), err)
 		}
 	}
+
+	// Measure how long we wait for gather to accept the result, when gather
+	// cannot keep up this time grows
+	sendStart := time.Now()
+	results <- r
+	st.addSendBlocked(time.Since(sendStart))
+
+	return true
 }
@@ -0,0 +1,238 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTestRunner starts the dispatcher of a run connecting to addr without
+// pool, each xact opens its own connection there. The returned function
+// stops the run and waits for the dispatcher.
+func startTestRunner(t *testing.T, addr string, r *run) (*runner, func()) {
+	t.Helper()
+
+	poolConfig, err := pgxpool.ParseConfig(fmt.Sprintf("postgres://lowrunner@%s/lowrunner?sslmode=disable", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolConfig.LazyConnect = true
+
+	pool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &config{
+		noPool:            true,
+		resultsBuffer:     100,
+		statsInterval:     10 * time.Millisecond,
+		statsWindow:       1,
+		histSteps:         10,
+		breakerWindow:     1,
+		maxFailureWindows: 1,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs := newRunnerSet(ctx, poolConfig, opts, cancel)
+
+	rn, err := rs.start(defaultRunName, pool, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rn, func() {
+		cancel()
+		rs.close()
+	}
+}
+
+// refusedAddr gives an address where connections are refused
+func refusedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+// cpuTime gives the CPU time used by the process so far
+func cpuTime(t *testing.T) time.Duration {
+	t.Helper()
+
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatal(err)
+	}
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func TestDispatchWithoutXacts(t *testing.T) {
+	r := newRun(ctrlData{Workers: 1, Frequency: time.Hour}, newRunInfo(nil))
+	rn, stop := startTestRunner(t, refusedAddr(t), r)
+	defer stop()
+
+	// Without xacts, dispatch must sleep until the next tick, which does
+	// not come during the test, instead of looping
+	start := time.Now()
+	cpu := cpuTime(t)
+	time.Sleep(500 * time.Millisecond)
+	if used := cpuTime(t) - cpu; used > time.Since(start)/2 {
+		t.Fatalf("dispatch is spinning without xacts: %s of CPU in %s", used, time.Since(start))
+	}
+
+	if f := rn.stats.snapshot().Failures; f != 0 {
+		t.Fatalf("expected no xact to run, got %d failures", f)
+	}
+
+	// Adding a xact wakes dispatch up without waiting for the tick, the
+	// xact fails on the refused connection
+	r.m.Lock()
+	if err := r.Work.add(newXact([]string{"SELECT 1"})); err != nil {
+		r.m.Unlock()
+		t.Fatal(err)
+	}
+	r.m.Unlock()
+	notifyDispatch(rn.ctrl)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rn.stats.snapshot().Failures == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the xact added was not run before the next tick")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stallServer accepts connections and never answers, the connections stay
+// open until the client closes them
+type stallServer struct {
+	l     net.Listener
+	m     sync.Mutex
+	conns []net.Conn
+
+	// Called on each connection accepted with the ones accepted before
+	onAccept func(c net.Conn, before []net.Conn)
+}
+
+func newStallServer(t *testing.T) *stallServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stallServer{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			s.m.Lock()
+			before := append([]net.Conn(nil), s.conns...)
+			s.conns = append(s.conns, c)
+			onAccept := s.onAccept
+			s.m.Unlock()
+
+			if onAccept != nil {
+				onAccept(c, before)
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *stallServer) accepted() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return len(s.conns)
+}
+
+func (s *stallServer) close() {
+	s.l.Close()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+// closedByClient tells if the client closed the connection, the unread
+// startup message of the client is skipped
+func closedByClient(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := io.Copy(io.Discard, c)
+
+	return err == nil || !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestDispatchDrainsPreviousRunOnLoad(t *testing.T) {
+	srv := newStallServer(t)
+	defer srv.close()
+
+	// The workers of the first run stay in flight, waiting for the server
+	// to answer
+	r := newRun(ctrlData{Workers: 2, Frequency: time.Hour}, newRunInfo([]xact{newXact([]string{"SELECT 1"})}))
+	rn, stop := startTestRunner(t, srv.l.Addr().String(), r)
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.accepted() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the workers of the first run did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// From now on, every connection comes from the new run: the ones of
+	// the previous run must be closed by then
+	old := 2
+	notDrained := make(chan int, 10)
+	srv.m.Lock()
+	srv.onAccept = func(c net.Conn, before []net.Conn) {
+		open := 0
+		for _, o := range before[:old] {
+			if !closedByClient(o) {
+				open++
+			}
+		}
+		notDrained <- open
+	}
+	srv.m.Unlock()
+
+	r.m.Lock()
+	r.load(ctrlData{Workers: 1, Frequency: time.Hour}, newRunInfo([]xact{newXact([]string{"SELECT 2"})}))
+	r.m.Unlock()
+	notifyDispatch(rn.ctrl)
+
+	select {
+	case open := <-notDrained:
+		if open > 0 {
+			t.Fatalf("the new run started with %d xacts of the previous run in flight", open)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new run did not start")
+	}
+}
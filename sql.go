@@ -3,11 +3,25 @@ package main
 import (
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/puddle"
 	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,8 +32,43 @@ const (
 	Commit               = "commit"
 	Rollback             = "rollback"
 	Idle                 = "idle"
+
+	// The server terminated the session for staying idle in transaction
+	// longer than idle_in_transaction_session_timeout
+	Terminated = "terminated"
 )
 
+// parseOutcome checks the expected outcome of a xact given by the user
+func parseOutcome(s string) (xactOutcome, error) {
+	switch o := xactOutcome(strings.ToLower(s)); o {
+	case Commit, Rollback, Idle:
+		return o, nil
+	}
+
+	return NotRun, fmt.Errorf("invalid outcome %q, must be commit, rollback or idle", s)
+}
+
+// checkHold makes sure the idle outcome comes with a hold time and a
+// transaction to hold, and that only idle xacts have a hold time
+func checkHold(o xactOutcome, hold time.Duration, autocommit bool) error {
+	if o != Idle {
+		if hold != 0 {
+			return fmt.Errorf("hold is only allowed with the idle outcome")
+		}
+		return nil
+	}
+
+	if hold <= 0 {
+		return fmt.Errorf("the idle outcome needs a positive hold")
+	}
+
+	if autocommit {
+		return fmt.Errorf("the idle outcome holds a transaction, it cannot be used with autocommit")
+	}
+
+	return nil
+}
+
 // xact represents a set of SQL statement that must be executed inside a
 // transaction.
 type xact struct {
@@ -30,21 +79,248 @@ type xact struct {
 	// Plain SQL text to run
 	source string
 
+	// Label given to the xact to recognize it in the logs and the stats, it
+	// is not part of the source so it does not change the id
+	Name string `json:"name,omitempty"`
+
 	// List of individual SQL statements
 	Statements []stmt `json:"statements"`
 
 	// Expected outcome of the transaction
 	Outcome xactOutcome `json:"outcome"`
+
+	// With the idle outcome, time the transaction is left idle after the
+	// statements, holding its connection, before it is rollbacked
+	Hold time.Duration `json:"hold,omitempty"`
+
+	// Run each statement in its own implicit transaction, without
+	// BEGIN/COMMIT around the statements
+	Autocommit bool `json:"autocommit"`
+
+	// Disabled xacts are kept in the run but not scheduled, this is not
+	// part of the source
+	Enabled bool `json:"enabled"`
+
+	// Number of workers of the xact for each worker of the schedule, to
+	// give more concurrency to a hot xact, 0 is the same as 1. It is not
+	// part of the source and not used by the ordered schedule.
+	WorkerMultiplier int `json:"worker_multiplier,omitempty"`
+
+	// Number of times the transaction is run again when it fails on a
+	// serialization failure or a deadlock, not used in autocommit
+	MaxRetries int `json:"max_retries"`
+
+	// Send the statements with EXPLAIN ANALYZE to get the execution time
+	// measured by PostgreSQL, COPY statements are sent as is
+	ServerTiming bool `json:"server_timing"`
+
+	// Parameters set with SET LOCAL after BEGIN, so that they do not stay
+	// on the connection, not used in autocommit
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Name of a parameter of PostgreSQL, custom ones have a prefix with a dot
+var settingName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func validateSettings(settings map[string]string) error {
+	for k := range settings {
+		if !settingName.MatchString(k) {
+			return fmt.Errorf("invalid setting name %q", k)
+		}
+	}
+
+	return nil
+}
+
+// settingNames gives the names of the settings in order, so that the source
+// and the queries do not depend on the order of the map
+func (x xact) settingNames() []string {
+	names := make([]string, 0, len(x.Settings))
+	for k := range x.Settings {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
+// settingsQuery sets all the settings of the xact in a single round trip,
+// set_config() with true is the same as SET LOCAL
+func (x xact) settingsQuery() string {
+	calls := make([]string, 0, len(x.Settings))
+	for _, k := range x.settingNames() {
+		calls = append(calls, fmt.Sprintf("set_config(%s, %s, true)", quoteLiteral(k), quoteLiteral(x.Settings[k])))
+	}
+
+	return "SELECT " + strings.Join(calls, ", ")
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// workers gives the number of workers of the xact for each worker of the
+// schedule
+func (x xact) workers() int {
+	if x.WorkerMultiplier < 1 {
+		return 1
+	}
+
+	return x.WorkerMultiplier
+}
+
+// label gives the id of the xact along with its name for the logs
+func (x xact) label() string {
+	return xactLabel(x.id, x.Name)
+}
+
+func xactLabel(id string, name string) string {
+	if name == "" {
+		return id
+	}
+
+	return fmt.Sprintf("%s name=%s", id, name)
+}
+
+// Prefix of the statements of the xacts with ServerTiming
+const explainAnalyze = "EXPLAIN (ANALYZE, FORMAT JSON) "
+
 type stmt struct {
 	id   string
 	Text string `json:"sql"`
+
+	// When set, the statement is a COPY FROM STDIN using the copy protocol
+	Copy *copyFrom `json:"copy,omitempty"`
+
+	// Deadline of the statement on the client side, defaultStmtTimeout when
+	// zero
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Number of rows the statement must return, the statement fails
+	// otherwise
+	ExpectRows *rowRange `json:"expect_rows,omitempty"`
+
+	// Number of rows read before the rest of the result is discarded, like
+	// a client reading the first page, 0 reads them all. Without FetchSize,
+	// the server still sends the whole result, pgx discards the rows after
+	// MaxRows when the rows are closed.
+	MaxRows int `json:"max_rows,omitempty"`
+
+	// When set, the statement is run through a cursor, its rows are fetched
+	// by batches of FetchSize rows
+	FetchSize int `json:"fetch_size,omitempty"`
+
+	// Values bound to the placeholders of the statement, $1 being the
+	// first one, drawn each time it runs
+	Params []param `json:"params,omitempty"`
+
+	// When set, the statement is a pause on the client side instead of SQL,
+	// to hold the locks of the xact longer. A random time up to Jitter is
+	// added to the pause.
+	Sleep  time.Duration `json:"sleep,omitempty"`
+	Jitter time.Duration `json:"jitter,omitempty"`
+}
+
+// sleepTime gives the duration of a sleep statement, drawn from rng when it
+// has a jitter
+func (s stmt) sleepTime() time.Duration {
+	if s.Jitter <= 0 {
+		return s.Sleep
+	}
+
+	return s.Sleep + time.Duration(rng.Int63n(int64(s.Jitter)+1))
+}
+
+// rowRange is an expected number of rows, given as a number for an exact
+// count or as an object with a min and a max, both optional
+type rowRange struct {
+	Min int  `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+}
+
+func (r *rowRange) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*r = rowRange{Min: n, Max: &n}
+		return nil
+	}
+
+	// Use another type to avoid calling this method again
+	type object rowRange
+	var o object
+	if err := json.Unmarshal(data, &o); err != nil {
+		return err
+	}
+
+	*r = rowRange(o)
+	return nil
+}
+
+func (r rowRange) MarshalJSON() ([]byte, error) {
+	if r.Max != nil && *r.Max == r.Min {
+		return json.Marshal(r.Min)
+	}
+
+	type object rowRange
+	return json.Marshal(object(r))
+}
+
+func (r rowRange) validate() error {
+	if r.Min < 0 {
+		return fmt.Errorf("expect_rows min must be greater than or equal to 0")
+	}
+
+	if r.Max != nil && *r.Max < r.Min {
+		return fmt.Errorf("expect_rows max must be greater than or equal to min")
+	}
+
+	return nil
+}
+
+func (r rowRange) String() string {
+	switch {
+	case r.Max == nil:
+		return fmt.Sprintf("at least %d", r.Min)
+	case *r.Max == r.Min:
+		return fmt.Sprintf("%d", r.Min)
+	default:
+		return fmt.Sprintf("between %d and %d", r.Min, *r.Max)
+	}
+}
+
+// check tells if the number of rows matches the expected range
+func (r rowRange) check(n int) error {
+	if n < r.Min || (r.Max != nil && n > *r.Max) {
+		return fmt.Errorf("expected %s rows, got %d", r, n)
+	}
+
+	return nil
+}
+
+// Time given to a statement when it has no timeout of its own
+const defaultStmtTimeout = 5 * time.Second
+
+// sql returns the text of the statement as it appears in the source of the
+// xact
+func (s stmt) sql() string {
+	if s.Copy != nil {
+		return s.Copy.text()
+	}
+
+	if s.Sleep > 0 {
+		if s.Jitter > 0 {
+			return fmt.Sprintf("SLEEP %s JITTER %s", s.Sleep, s.Jitter)
+		}
+		return fmt.Sprintf("SLEEP %s", s.Sleep)
+	}
+
+	return s.Text
 }
 
 func defaultXact() xact {
 	x := xact{
 		Outcome: Commit,
+		Enabled: true,
 		Statements: []stmt{
 			{Text: "SELECT 1"},
 			{Text: "SELECT * FROM generate_series(0, 150) i"},
@@ -65,6 +341,7 @@ func pgbenchXact(scale int) xact {
 
 	x := xact{
 		Outcome: Commit,
+		Enabled: true,
 		Statements: []stmt{
 			{Text: fmt.Sprintf("UPDATE pgbench_accounts SET abalance = abalance + (%s) WHERE aid = (%s)", delta, aid)},
 			{Text: fmt.Sprintf("SELECT abalance FROM pgbench_accounts WHERE aid = (%s)", aid)},
@@ -82,6 +359,7 @@ func pgbenchXact(scale int) xact {
 func newXact(sql []string) xact {
 	x := xact{
 		Outcome: Commit,
+		Enabled: true,
 	}
 
 	stmts := make([]stmt, 0)
@@ -96,31 +374,335 @@ func newXact(sql []string) xact {
 	return x
 }
 
+// Tag starting or ending a dollar quoted string, like $$ or $body$
+var dollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// quotedLen gives the length of the string literal, quoted identifier,
+// dollar quoted body or comment starting at i in text, 0 when there is none.
+// Their content is kept as is when SQL text is normalized or split.
+func quotedLen(text string, i int) (int, error) {
+	c := text[i]
+
+	switch {
+	case c == '\'' || c == '"':
+		// Quotes are escaped by doubling them, backslashes escape
+		// characters in E'' strings
+		escapes := c == '\'' && i > 0 && (text[i-1] == 'E' || text[i-1] == 'e')
+		j := i + 1
+		for ; j < len(text); j++ {
+			if escapes && text[j] == '\\' {
+				j++
+				continue
+			}
+
+			if text[j] == c {
+				if j+1 < len(text) && text[j+1] == c {
+					j++
+					continue
+				}
+				break
+			}
+		}
+		if j >= len(text) {
+			return 0, fmt.Errorf("unterminated quoted string")
+		}
+		return j - i + 1, nil
+
+	case c == '$':
+		// Positional parameters like $1 are not tags
+		tag := dollarTag.FindString(text[i:])
+		if tag == "" {
+			return 0, nil
+		}
+
+		end := strings.Index(text[i+len(tag):], tag)
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated dollar quoted string")
+		}
+		return len(tag) + end + len(tag), nil
+
+	case c == '-' && strings.HasPrefix(text[i:], "--"):
+		// The comment ends with the newline
+		end := strings.IndexByte(text[i:], '\n')
+		if end < 0 {
+			return len(text) - i, nil
+		}
+		return end + 1, nil
+
+	case c == '/' && strings.HasPrefix(text[i:], "/*"):
+		// Block comments can be nested
+		depth := 0
+		j := i
+		for ; j < len(text); j++ {
+			if strings.HasPrefix(text[j:], "/*") {
+				depth++
+				j++
+			} else if strings.HasPrefix(text[j:], "*/") {
+				depth--
+				j++
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		if depth > 0 {
+			return 0, fmt.Errorf("unterminated comment")
+		}
+		return j - i + 1, nil
+	}
+
+	return 0, nil
+}
+
+// normalizeSQL rewrites SQL text so that xacts differing only in their
+// layout get the same id: with whitespace, runs of spaces, tabs and newlines
+// become a single space, with case, unquoted text is lowercased too, like
+// PostgreSQL folds unquoted identifiers. String literals, quoted identifiers,
+// dollar quoted bodies and comments are kept as is. With none, or when the
+// text cannot be scanned, it is not changed.
+func normalizeSQL(text string, level string) string {
+	if level != "whitespace" && level != "case" {
+		return text
+	}
+
+	var b strings.Builder
+	space := false
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			// The newline ending a comment already separates the words
+			space = b.Len() > 0 && !strings.HasSuffix(b.String(), "\n")
+			continue
+		}
+
+		// Length of the part to keep as is, from i
+		keep, err := quotedLen(text, i)
+		if err != nil {
+			return text
+		}
+
+		if space {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		if keep > 0 {
+			b.WriteString(text[i : i+keep])
+			i += keep - 1
+			continue
+		}
+
+		if level == "case" && c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// splitScript cuts a SQL script into statements on the semicolons, those
+// inside string literals, quoted identifiers, dollar quoted bodies and
+// comments do not count. Statements made only of comments are left out.
+func splitScript(script string) ([]string, error) {
+	stmts := make([]string, 0)
+	start := 0
+	empty := true
+
+	add := func(end int) {
+		if !empty {
+			stmts = append(stmts, strings.TrimSpace(script[start:end]))
+		}
+		start = end + 1
+		empty = true
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if c != ';' && c != ' ' && c != '\t' && c != '\n' && c != '\r' &&
+			!strings.HasPrefix(script[i:], "--") && !strings.HasPrefix(script[i:], "/*") {
+			empty = false
+		}
+
+		if c == ';' {
+			add(i)
+			continue
+		}
+
+		n, err := quotedLen(script, i)
+		if err != nil {
+			return nil, fmt.Errorf("%w in script", err)
+		}
+		if n > 0 {
+			i += n - 1
+		}
+	}
+
+	add(len(script))
+
+	return stmts, nil
+}
+
 func (x *xact) genSource() {
-	src := "BEGIN;"
+	lines := make([]string, 0, len(x.Statements)+2)
+
+	if !x.Autocommit {
+		lines = append(lines, "BEGIN;")
+
+		for _, k := range x.settingNames() {
+			lines = append(lines, fmt.Sprintf("SET LOCAL %s = %s;", k, quoteLiteral(x.Settings[k])))
+		}
+	}
 
 	for _, s := range x.Statements {
+		if s.Copy != nil {
+			lines = append(lines, s.Copy.text())
+			continue
+		}
+
+		// Sleeps are not sent, keep them as comments
+		if s.Sleep > 0 {
+			lines = append(lines, "-- "+s.sql())
+			continue
+		}
+
 		s.Text = strings.TrimRight(s.Text, "\n\r\t ")
 		if !strings.HasSuffix(s.Text, ";") {
 			s.Text += ";"
 		}
 
-		src = fmt.Sprintf("%s\n%s", src, s.Text)
+		if x.ServerTiming {
+			s.Text = explainAnalyze + s.Text
+		}
+
+		// The timeout changes how the xact runs, keep it in the source so
+		// that the id is different
+		if s.Timeout > 0 {
+			s.Text += fmt.Sprintf(" -- timeout=%s", s.Timeout)
+		}
+
+		if s.ExpectRows != nil {
+			s.Text += fmt.Sprintf(" -- expect_rows=%s", s.ExpectRows)
+		}
+
+		if s.MaxRows > 0 {
+			s.Text += fmt.Sprintf(" -- max_rows=%d", s.MaxRows)
+		}
+
+		if s.FetchSize > 0 {
+			s.Text += fmt.Sprintf(" -- fetch_size=%d", s.FetchSize)
+		}
+
+		if len(s.Params) > 0 {
+			s.Text += fmt.Sprintf(" -- params=%s", paramsText(s.Params))
+		}
+
+		lines = append(lines, s.Text)
+	}
+
+	if x.Outcome == Idle {
+		lines = append(lines, fmt.Sprintf("-- idle in transaction for %s", x.Hold), "ROLLBACK;")
+	} else if !x.Autocommit {
+		lines = append(lines, fmt.Sprintf("%s;", strings.ToUpper(string(x.Outcome))))
 	}
 
-	src = fmt.Sprintf("%s\n%s;", src, strings.ToUpper(string(x.Outcome)))
+	src := strings.Join(lines, "\n")
 
 	x.source = src
-	x.id = fmt.Sprintf("%x", sha1.Sum([]byte(src)))
+	x.id = xactIds.id(src)
+}
+
+// idScheme tells how the id of a xact is computed from its source: the hex
+// digest of the hash, truncated to length characters when not 0
+type idScheme struct {
+	hash   string
+	length int
+
+	// How the source is normalized before it is hashed, see normalizeSQL
+	normalize string
+}
+
+// Shortest truncated id accepted, collisions are detected when adding xacts
+// but they must remain unlikely
+const minXactIdLength = 8
+
+// xactIds is the scheme used for all the xacts, it is set once at startup
+// before any xact is created
+var xactIds = idScheme{hash: "sha1", normalize: "none"}
+
+func newIdScheme(hash string, length int, normalize string) (idScheme, error) {
+	size := 0
+	switch hash {
+	case "sha1":
+		size = sha1.Size * 2
+	case "sha256":
+		size = sha256.Size * 2
+	default:
+		return idScheme{}, fmt.Errorf("invalid xact id hash %q, must be sha1 or sha256", hash)
+	}
+
+	if length != 0 && (length < minXactIdLength || length > size) {
+		return idScheme{}, fmt.Errorf("xact id length must be 0 or between %d and %d with %s", minXactIdLength, size, hash)
+	}
+
+	switch normalize {
+	case "none", "whitespace", "case":
+	default:
+		return idScheme{}, fmt.Errorf("invalid xact id normalization %q, must be none, whitespace or case", normalize)
+	}
+
+	return idScheme{hash: hash, length: length, normalize: normalize}, nil
+}
+
+// sameSource tells if two sources give the same xact, once normalized
+func (s idScheme) sameSource(a string, b string) bool {
+	return normalizeSQL(a, s.normalize) == normalizeSQL(b, s.normalize)
+}
+
+func (s idScheme) id(src string) string {
+	src = normalizeSQL(src, s.normalize)
+
+	var id string
+	if s.hash == "sha256" {
+		id = fmt.Sprintf("%x", sha256.Sum256([]byte(src)))
+	} else {
+		id = fmt.Sprintf("%x", sha1.Sum([]byte(src)))
+	}
+
+	if s.length > 0 && s.length < len(id) {
+		id = id[:s.length]
+	}
+
+	return id
 }
 
 type xactResult struct {
-	// Id of the xact that produced this result
-	xactId string
+	// Id and name of the xact that produced this result, and the trace id
+	// of the execution given in the statements with --tag-queries
+	xactId   string
+	xactName string
+	trace    string
+
+	// Slot of the worker that ran the xact in its round
+	client int
 
-	// time when the connection was acquired
+	// time when the xact was started, before getting a connection
 	startTime time.Time
 
+	// time when the connection was obtained, from the pool or by opening a
+	// new one
+	acquireTime time.Time
+
+	// time spent opening a new connection while acquiring it, zero when an
+	// established connection was reused
+	connectTime time.Duration
+
+	// class of the error when no connection could be acquired, see
+	// classifyAcquireError
+	acquireError string
+
 	// time when the BEGIN statement returned from PostgreSQL
 	beginTime time.Time
 
@@ -129,117 +711,1149 @@ type xactResult struct {
 
 	// the real outcome of the xact
 	outcome xactOutcome
-}
 
-type stmtResult struct {
-	stmtId    string
-	startTime time.Time
-	stopTime  time.Time
-	count     int
-	failed    bool
-}
-
-func runXact(x xact, pool *pgxpool.Pool) (xactResult, error) {
-	res := xactResult{
-		xactId:    x.id,
-		startTime: time.Now(),
-		outcome:   Rollback,
-	}
+	// the xact did not run as expected: no connection could be acquired
+	// or a statement, the BEGIN or the COMMIT failed
+	failed bool
 
-	// We want to get a connection within 5 seconds
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// number of times the transaction was run again after a serialization
+	// failure or a deadlock
+	retries int
 
-	conn, err := pool.Acquire(ctxTimeout)
-	if err != nil {
-		return res, err
-	}
+	// results of the statements, in order
+	stmts []stmtResult
 
-	defer conn.Release()
+	// error returned by the run, when the xact failed outside of its
+	// statements
+	err error
+}
 
-	// Start the transaction and record the time after we got an answer
-	tx, err := conn.Begin(ctxTimeout)
-	if err != nil {
-		return res, err
+// failure returns the error that made the xact fail: the error of the run
+// or the one of the first statement that failed
+func (r xactResult) failure() error {
+	if r.err != nil {
+		return r.err
 	}
 
-	res.beginTime = time.Now()
-
-	res.outcome = Commit
-	for _, s := range x.Statements {
-		if _, err := runStatement(s, tx); err != nil {
-			log.Printf("xact=%s rollbacked: %s", x.id, err)
-			res.outcome = Rollback
+	for _, s := range r.stmts {
+		if s.err != nil {
+			return s.err
 		}
 	}
 
-	switch res.outcome {
-	case Commit:
-		tx.Commit(ctxTimeout)
-	case Rollback:
-		tx.Rollback(ctxTimeout)
-	}
+	return nil
+}
 
-	res.endTime = time.Now()
+// sqlState gives the SQLSTATE of an error returned by PostgreSQL, it is empty
+// for other errors
+func sqlState(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
 
-	return res, nil
+	return ""
 }
 
-func runStatement(s stmt, tx pgx.Tx) (stmtResult, error) {
-	res := stmtResult{
-		stmtId:    s.id,
-		startTime: time.Now(),
+// classifyAcquireError tells why a connection could not be acquired: the
+// timeout expired waiting for the pool or the server, the pool is closed,
+// the server refused the connection or is full, the authentication failed,
+// or another network or server error. The acquire timeout is not a
+// cancellation of ctx.
+func classifyAcquireError(ctx context.Context, err error) string {
+	if errors.Is(err, puddle.ErrClosedPool) {
+		return "pool-closed"
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	rows, err := tx.Query(ctxTimeout, s.Text)
-	if err != nil {
-		res.failed = true
-		res.stopTime = time.Now()
-		return res, err
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return "acquire-timeout"
 	}
 
-	for rows.Next() {
-		res.count++
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "conn-refused"
 	}
 
-	res.stopTime = time.Now()
+	switch code := sqlState(err); {
+	case code == "53300":
+		return "too-many-connections"
+	case strings.HasPrefix(code, "28"):
+		return "auth"
+	case code != "":
+		return "server"
+	}
 
-	if rows.Err() != nil {
-		res.failed = true
-		return res, rows.Err()
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "acquire-timeout"
+		}
+		return "network"
 	}
 
-	return res, nil
+	return "other"
 }
 
-func setupPG(connstring string, lazyConnect bool) (*pgxpool.Pool, error) {
-	config, err := pgxpool.ParseConfig(connstring)
-	if err != nil {
-		return nil, err
-	}
+type stmtResult struct {
+	stmtId       string
+	text         string
+	startTime    time.Time
+	stopTime     time.Time
+	count        int
+	rowsAffected int64
+	copied       int64
+	failed       bool
+	timedOut     bool
+	err          error
 
-	config.LazyConnect = lazyConnect
+	// The rows after max_rows were not read
+	truncated bool
 
-	conn, err := pgxpool.ConnectConfig(context.Background(), config)
-	if err != nil {
-		return nil, err
-	}
+	// Duration of each FETCH of a statement run through a cursor
+	fetches []time.Duration
 
-	return conn, nil
+	// Execution time reported by EXPLAIN ANALYZE, when asked for
+	serverTime time.Duration
 }
 
-func updatePoolConfig(pool *pgxpool.Pool, maxConns int) (*pgxpool.Pool, error) {
-	if maxConns < 1 {
-		return nil, fmt.Errorf("new pool size is too small")
+// connTiming is given in the context of an acquire to learn if a new
+// connection was opened and how long it took, the hooks of the pool fill it
+type connTiming struct {
+	start   time.Time
+	connect time.Duration
+}
+
+type connTimingKey struct{}
+
+func withConnTiming(ctx context.Context) (context.Context, *connTiming) {
+	t := &connTiming{}
+	return context.WithValue(ctx, connTimingKey{}, t), t
+}
+
+func connTimingFrom(ctx context.Context) *connTiming {
+	t, _ := ctx.Value(connTimingKey{}).(*connTiming)
+	return t
+}
+
+// tagQueries makes the statements start with a comment naming the xact and
+// the trace id of the execution, so that they can be found in
+// pg_stat_activity and the logs of PostgreSQL. It is set once at startup.
+var tagQueries bool
+
+// Trace ids are the start time of the process followed by a sequence, they
+// are unique without drawing from rng, which would change a seeded run
+var (
+	traceStart = time.Now().Unix()
+	traceSeq   uint64
+)
+
+func newTraceId() string {
+	return fmt.Sprintf("%x-%d", traceStart, atomic.AddUint64(&traceSeq, 1))
+}
+
+type queryTagKey struct{}
+
+func withQueryTag(ctx context.Context, x xact, trace string) context.Context {
+	return context.WithValue(ctx, queryTagKey{}, fmt.Sprintf("/* low-runner xact=%s trace=%s */ ", x.id, trace))
+}
+
+func queryTagFrom(ctx context.Context) string {
+	t, _ := ctx.Value(queryTagKey{}).(string)
+	return t
+}
+
+// connSource gives the connection a xact runs on, along with the function to
+// call when the xact is done with it
+type connSource interface {
+	acquire(ctx context.Context) (*pgx.Conn, func(), error)
+}
+
+// poolSource takes the connections from the pool of the run
+type poolSource struct {
+	pool *pgxpool.Pool
+}
+
+func (s poolSource) acquire(ctx context.Context) (*pgx.Conn, func(), error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn.Conn(), conn.Release, nil
+}
+
+// connectSource opens a new connection for each xact and closes it
+// afterwards, like clients connecting on each request
+type connectSource struct {
+	config *pgx.ConnConfig
+
+	// Hook of the pool configuration, so that sessions are setup the same
+	// way in both modes
+	afterConnect func(context.Context, *pgx.Conn) error
+}
+
+func (s connectSource) acquire(ctx context.Context) (*pgx.Conn, func(), error) {
+	start := time.Now()
+	conn, err := pgx.ConnectConfig(ctx, s.config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if t := connTimingFrom(ctx); t != nil {
+		t.connect = time.Since(start)
+	}
+
+	if s.afterConnect != nil {
+		if err := s.afterConnect(ctx, conn); err != nil {
+			conn.Close(context.Background())
+			return nil, nil, err
+		}
+	}
+
+	return conn, func() { conn.Close(context.Background()) }, nil
+}
+
+// sessionSource gives the same connection to all the xacts, taken once from
+// another source, so that they run one after another in a single session.
+// A new one is taken when the connection was closed, like when the server
+// terminated it. It is not safe for concurrent use.
+type sessionSource struct {
+	src     connSource
+	conn    *pgx.Conn
+	release func()
+}
+
+func (s *sessionSource) acquire(ctx context.Context) (*pgx.Conn, func(), error) {
+	if s.conn != nil && s.conn.IsClosed() {
+		s.close()
+	}
+
+	if s.conn == nil {
+		conn, release, err := s.src.acquire(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		s.conn, s.release = conn, release
+	}
+
+	return s.conn, func() {}, nil
+}
+
+// close gives the connection back to the source
+func (s *sessionSource) close() {
+	if s.release != nil {
+		s.release()
+	}
+
+	s.conn, s.release = nil, nil
+}
+
+// runXact executes the statements of a xact on a connection from src, when
+// ctx is canceled the statement in flight is canceled too
+func runXact(ctx context.Context, x xact, src connSource) (xactResult, error) {
+	res := xactResult{
+		xactId:    x.id,
+		xactName:  x.Name,
+		startTime: time.Now(),
+		outcome:   Rollback,
+	}
+
+	if tagQueries {
+		res.trace = newTraceId()
+		ctx = withQueryTag(ctx, x, res.trace)
+	}
+
+	// We want to get a connection within 5 seconds
+	ctxTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	live := liveCountersFrom(ctx)
+	if live != nil {
+		atomic.AddInt64(&live.acquiring, 1)
+	}
+
+	acquireCtx, timing := withConnTiming(ctxTimeout)
+	conn, release, err := src.acquire(acquireCtx)
+	if live != nil {
+		atomic.AddInt64(&live.acquiring, -1)
+	}
+
+	if err != nil {
+		res.failed = true
+		res.acquireError = classifyAcquireError(ctx, err)
+		return res, err
+	}
+
+	defer release()
+
+	res.acquireTime = time.Now()
+	res.connectTime = timing.connect
+
+	if x.Autocommit {
+		// Without explicit transaction, statements are sent directly on
+		// the connection and each one is committed by PostgreSQL
+		res.beginTime = time.Now()
+
+		res.outcome = Commit
+		for _, s := range x.Statements {
+			sr, err := runStatement(ctx, s, conn, x.ServerTiming)
+			if err != nil {
+				log.Printf("xact=%s statement failed: %s", x.id, err)
+				res.outcome = Rollback
+				res.failed = true
+			}
+			res.stmts = append(res.stmts, sr)
+		}
+
+		res.endTime = time.Now()
+
+		return res, nil
+	}
+
+	// Transactions failing on a serialization failure or a deadlock are
+	// run again, like an application would do
+	for {
+		retry, err := runTx(ctx, x, conn, &res)
+		if !retry || res.retries >= x.MaxRetries {
+			return res, err
+		}
+
+		res.retries++
+		wait := retryBackoff(res.retries)
+		log.Printf("xact=%s retrying in %s, attempt %d of %d", x.id, wait, res.retries, x.MaxRetries)
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runTx runs the statements of the xact in a transaction, it tells if the
+// transaction failed on an error worth retrying. The begin time is the one
+// of the first attempt so that the time spent retrying is accounted.
+func runTx(ctx context.Context, x xact, conn *pgx.Conn, res *xactResult) (bool, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res.stmts = nil
+	res.failed = false
+	res.outcome = Rollback
+
+	// Start the transaction and record the time after we got an answer
+	tx, err := conn.Begin(ctxTimeout)
+	if err != nil {
+		res.failed = true
+		return false, err
+	}
+
+	if res.beginTime.IsZero() {
+		res.beginTime = time.Now()
+	}
+
+	// The statements must run with the settings, there is no point running
+	// them when the settings could not be applied
+	if len(x.Settings) > 0 {
+		if _, err := tx.Exec(ctxTimeout, x.settingsQuery()); err != nil {
+			log.Printf("xact=%s could not apply the settings: %s", x.id, err)
+			tx.Rollback(ctxTimeout)
+			res.endTime = time.Now()
+			res.failed = true
+			return false, err
+		}
+	}
+
+	// End the transaction the way the xact expects, unless a statement
+	// fails
+	res.outcome = Commit
+	if x.Outcome == Rollback || x.Outcome == Idle {
+		res.outcome = x.Outcome
+	}
+
+	retry := false
+	for _, s := range x.Statements {
+		sr, err := runStatement(ctx, s, tx, x.ServerTiming)
+		if isIdleTermination(err) {
+			// The connection is gone, the next statements cannot run
+			sr.err = err
+			log.Printf("xact=%s terminated by the server for being idle in transaction: %s", x.id, err)
+			res.stmts = append(res.stmts, sr)
+			res.outcome = Terminated
+			res.endTime = time.Now()
+			res.failed = true
+			return false, nil
+		}
+
+		if err != nil {
+			err = hintAutocommit(err)
+			sr.err = err
+			log.Printf("xact=%s rollbacked: %s", x.id, err)
+			retry = retry || isRetryable(err)
+			res.outcome = Rollback
+			res.failed = true
+		}
+		res.stmts = append(res.stmts, sr)
+	}
+
+	switch res.outcome {
+	case Commit:
+		err = tx.Commit(ctxTimeout)
+	case Rollback:
+		err = tx.Rollback(ctxTimeout)
+	case Idle:
+		err = holdTx(ctx, x.Hold, tx)
+	}
+
+	res.endTime = time.Now()
+
+	if isIdleTermination(err) {
+		log.Printf("xact=%s terminated by the server for being idle in transaction: %s", x.id, err)
+		res.outcome = Terminated
+		res.failed = true
+		return false, err
+	}
+
+	if err != nil && !res.failed {
+		res.outcome = Rollback
+		res.failed = true
+		return isRetryable(err), err
+	}
+
+	return retry, nil
+}
+
+// isRetryable tells if running the transaction again may succeed after the
+// error: on serialization failures and deadlocks
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+
+	return false
+}
+
+// holdTx leaves the transaction idle for the hold time then rollbacks it,
+// the transactions held are counted in the live counters found in ctx
+func holdTx(ctx context.Context, hold time.Duration, tx pgx.Tx) error {
+	if live := liveCountersFrom(ctx); live != nil {
+		atomic.AddInt64(&live.held, 1)
+		defer atomic.AddInt64(&live.held, -1)
+	}
+
+	t := time.NewTimer(hold)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	// The timeout of the BEGIN has expired while holding
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return tx.Rollback(ctxTimeout)
+}
+
+type liveCountersKey struct{}
+
+// withLiveCounters gives the counters of the stats of the run to the xact,
+// to count the workers waiting for a connection and the transactions held
+func withLiveCounters(ctx context.Context, live *liveCounters) context.Context {
+	return context.WithValue(ctx, liveCountersKey{}, live)
+}
+
+func liveCountersFrom(ctx context.Context) *liveCounters {
+	live, _ := ctx.Value(liveCountersKey{}).(*liveCounters)
+	return live
+}
+
+// isIdleTermination tells if the server closed the session because the
+// transaction stayed idle longer than idle_in_transaction_session_timeout
+func isIdleTermination(err error) bool {
+	return sqlState(err) == "25P03"
+}
+
+// hintAutocommit explains how to run commands refusing to run in a
+// transaction block, like VACUUM or CREATE INDEX CONCURRENTLY, as the error
+// from PostgreSQL does not tell about the BEGIN sent by low-runner
+func hintAutocommit(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "25001" {
+		return fmt.Errorf("%w, set autocommit on the xact to send its statements outside of a transaction block", err)
+	}
+
+	return err
+}
+
+// retryBackoff gives the time to wait before an attempt, it doubles from 10ms
+// up to 1s, with some jitter so that the transactions conflicting together
+// do not retry at the same time
+func retryBackoff(attempt int) time.Duration {
+	d := time.Second
+	if attempt <= 7 {
+		d = 10 * time.Millisecond << uint(attempt-1)
+	}
+
+	return d/2 + time.Duration(rng.Int63n(int64(d/2)))
+}
+
+// execResult is the outcome of a one-off command
+type execResult struct {
+	tag      string
+	duration time.Duration
+}
+
+// execCommand runs a single command on a connection from src, outside of the
+// schedule. Without inTx the command is sent alone so that commands like
+// VACUUM, which cannot run in a transaction block, work.
+func execCommand(ctx context.Context, sql string, inTx bool, src connSource) (execResult, error) {
+	res := execResult{}
+
+	acquireCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, release, err := src.acquire(acquireCtx)
+	if err != nil {
+		return res, err
+	}
+
+	defer release()
+
+	start := time.Now()
+
+	if !inTx {
+		tag, err := conn.Exec(ctx, sql)
+		res.duration = time.Since(start)
+		res.tag = string(tag)
+		return res, err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	tag, err := tx.Exec(ctx, sql)
+	if err != nil {
+		tx.Rollback(ctx)
+		res.duration = time.Since(start)
+		return res, err
+	}
+
+	err = tx.Commit(ctx)
+	res.duration = time.Since(start)
+	res.tag = string(tag)
+
+	return res, err
+}
+
+// querier is what is needed to send a statement, a transaction or a
+// connection when running in autocommit
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+// runStatement sends a statement and reads its results, with analyze the
+// statement is wrapped in EXPLAIN ANALYZE to read the execution time
+func runStatement(ctx context.Context, s stmt, q querier, analyze bool) (stmtResult, error) {
+	res := stmtResult{
+		stmtId:    s.id,
+		text:      s.sql(),
+		startTime: time.Now(),
+	}
+
+	timeout := defaultStmtTimeout
+	if s.Timeout > 0 {
+		timeout = s.Timeout
+	}
+
+	if s.Sleep > 0 {
+		t := time.NewTimer(s.sleepTime())
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			res.failed = true
+			res.err = ctx.Err()
+		}
+		res.stopTime = time.Now()
+
+		return res, res.err
+	}
+
+	args, err := drawParams(s.Params)
+	if err != nil {
+		res.failed = true
+		res.err = err
+		res.stopTime = time.Now()
+		return res, err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if s.Copy != nil {
+		res, err := runCopy(ctxTimeout, s.Copy, q, res)
+		res.timedOut = timedOut(ctx, ctxTimeout)
+		if err == nil {
+			err = checkRows(s, &res)
+		}
+		return res, err
+	}
+
+	if s.FetchSize > 0 {
+		res, err := runCursor(ctxTimeout, s, q, res, args)
+		if err != nil {
+			res.failed = true
+			res.timedOut = timedOut(ctx, ctxTimeout)
+			res.err = err
+			return res, err
+		}
+		return res, checkRows(s, &res)
+	}
+
+	text := s.Text
+	if analyze {
+		text = explainAnalyze + s.Text
+	}
+	text = queryTagFrom(ctx) + text
+
+	rows, err := q.Query(ctxTimeout, text, args...)
+	if err != nil {
+		res.failed = true
+		res.timedOut = timedOut(ctx, ctxTimeout)
+		res.err = err
+		res.stopTime = time.Now()
+		return res, err
+	}
+
+	var plan []byte
+	for rows.Next() {
+		res.count++
+		if analyze {
+			err = rows.Scan(&plan)
+		}
+
+		// The plan of EXPLAIN is a single row, it is never cut
+		if !analyze && s.MaxRows > 0 && res.count >= s.MaxRows {
+			res.truncated = true
+			rows.Close()
+			break
+		}
+	}
+
+	res.stopTime = time.Now()
+
+	if rows.Err() != nil {
+		res.failed = true
+		res.timedOut = timedOut(ctx, ctxTimeout)
+		res.err = rows.Err()
+		return res, rows.Err()
+	}
+
+	res.rowsAffected = rows.CommandTag().RowsAffected()
+
+	if analyze {
+		if err == nil {
+			err = parseExplain(plan, &res)
+		}
+
+		if err != nil {
+			res.failed = true
+			res.err = fmt.Errorf("could not read EXPLAIN output: %w", err)
+			return res, res.err
+		}
+	}
+
+	return res, checkRows(s, &res)
+}
+
+// cursorName is the name of the cursors of the statements with a fetch size,
+// they are closed before the next statement so the name can be reused
+const cursorName = "lowrunner_cursor"
+
+// runCursor declares a cursor for the statement and fetches its rows by
+// batches until there are no more rows or max_rows is reached, the time of
+// each FETCH is kept in the result
+func runCursor(ctx context.Context, s stmt, q querier, res stmtResult, args []interface{}) (stmtResult, error) {
+	tag := queryTagFrom(ctx)
+	text := strings.TrimRight(strings.TrimSpace(s.Text), ";")
+
+	if _, err := q.Exec(ctx, fmt.Sprintf("%sDECLARE %s NO SCROLL CURSOR FOR %s", tag, cursorName, text), args...); err != nil {
+		res.stopTime = time.Now()
+		return res, err
+	}
+
+	for {
+		size := s.FetchSize
+		if s.MaxRows > 0 && s.MaxRows-res.count < size {
+			size = s.MaxRows - res.count
+		}
+
+		start := time.Now()
+		rows, err := q.Query(ctx, fmt.Sprintf("%sFETCH %d FROM %s", tag, size, cursorName))
+		if err != nil {
+			res.stopTime = time.Now()
+			return res, err
+		}
+
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		rows.Close()
+		res.fetches = append(res.fetches, time.Since(start))
+		res.count += n
+
+		if rows.Err() != nil {
+			res.stopTime = time.Now()
+			return res, rows.Err()
+		}
+
+		if n < size {
+			break
+		}
+
+		if s.MaxRows > 0 && res.count >= s.MaxRows {
+			res.truncated = true
+			break
+		}
+	}
+
+	_, err := q.Exec(ctx, fmt.Sprintf("%sCLOSE %s", tag, cursorName))
+	res.stopTime = time.Now()
+
+	return res, err
+}
+
+// checkRows fails the statement when it did not return the expected number
+// of rows
+func checkRows(s stmt, res *stmtResult) error {
+	if s.ExpectRows == nil {
+		return nil
+	}
+
+	if err := s.ExpectRows.check(res.count); err != nil {
+		res.failed = true
+		res.err = err
+		return err
+	}
+
+	return nil
+}
+
+// parseExplain reads the execution time and the number of rows of the top
+// node from the JSON output of EXPLAIN ANALYZE
+func parseExplain(data []byte, res *stmtResult) error {
+	var out []struct {
+		Plan struct {
+			ActualRows float64 `json:"Actual Rows"`
+		} `json:"Plan"`
+		ExecutionTime float64 `json:"Execution Time"`
+	}
+
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+
+	if len(out) == 0 {
+		return fmt.Errorf("empty plan")
+	}
+
+	res.serverTime = time.Duration(out[0].ExecutionTime * float64(time.Millisecond))
+	res.count = int(out[0].Plan.ActualRows)
+
+	return nil
+}
+
+// timedOut tells if the statement was stopped by its own deadline rather
+// than by the cancellation of the xact
+func timedOut(parent context.Context, ctx context.Context) bool {
+	return parent.Err() == nil && ctx.Err() == context.DeadlineExceeded
+}
+
+// runCopy sends the rows of a COPY using the copy protocol
+func runCopy(ctx context.Context, c *copyFrom, q querier, res stmtResult) (stmtResult, error) {
+	src, err := c.source()
+	if err != nil {
+		res.failed = true
+		res.err = err
+		res.stopTime = time.Now()
+		return res, err
+	}
+
+	n, err := q.CopyFrom(ctx, c.identifier(), c.Columns, src)
+	res.stopTime = time.Now()
+	if err != nil {
+		res.failed = true
+		res.err = err
+		return res, err
+	}
+
+	res.count = int(n)
+	res.rowsAffected = n
+	res.copied = n
+
+	return res, nil
+}
+
+// listen holds a dedicated connection listening on a channel until the
+// context is canceled, the connection is opened again on errors. When the
+// payload of a notification is an epoch, as given by extract(epoch from
+// clock_timestamp()), the time it took to receive it is recorded.
+func listen(ctx context.Context, connConfig *pgx.ConnConfig, channel string, st *stats) {
+	for {
+		err := listenOnce(ctx, connConfig, channel, st)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("listener on channel %s failed: %s", channel, redactError(err, connConfig.ConnString(), connConfig.Password))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func listenOnce(ctx context.Context, connConfig *pgx.ConnConfig, channel string, st *stats) error {
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		received := time.Now()
+
+		// A negative latency tells it is unknown
+		latency := time.Duration(-1)
+		if epoch, err := strconv.ParseFloat(n.Payload, 64); err == nil {
+			latency = received.Sub(time.Unix(0, int64(epoch*float64(time.Second))))
+		}
+
+		st.addNotification(latency)
+	}
+}
+
+// Placeholder for secrets in connection strings and error messages
+const redacted = "****"
+
+var passwordKeyword = regexp.MustCompile(`password\s*=\s*('(\\.|[^'\\])*'|[^\s]+)`)
+
+// redactConnString masks the password of a connection string, given as a URL
+// or as keyword/value pairs, so that it can be logged
+func redactConnString(connstring string) string {
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		u, err := url.Parse(connstring)
+		if err != nil {
+			// Do not take the risk to output a string we could not
+			// understand
+			return redacted
+		}
+
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+
+		q := u.Query()
+		if q.Get("password") != "" {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+
+		// Prevent the escaping of the placeholder
+		return strings.Replace(u.String(), url.QueryEscape(redacted), redacted, -1)
+	}
+
+	return passwordKeyword.ReplaceAllString(connstring, "password="+redacted)
+}
+
+// redactError removes the connection string and the password from the
+// message of an error, the password may come from the environment or a
+// passfile so it is searched for too
+func redactError(err error, connstring string, password string) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	if connstring != "" {
+		msg = strings.Replace(msg, connstring, redactConnString(connstring), -1)
+	}
+
+	if password != "" {
+		msg = strings.Replace(msg, password, redacted, -1)
+	}
+
+	return errors.New(msg)
+}
+
+// readPasswordFile gets the password from a file, like the secrets mounted in
+// containers, the line ending is not part of the password
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read password file: %w", err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// connParam is a setting added to the connection string
+type connParam struct {
+	key   string
+	value string
+}
+
+// addConnParams sets parameters in a connection string, given as a URL or
+// as keyword/value pairs, overriding the ones already there. This lets pgx
+// build the TLS configuration from the SSL options like it does from the
+// connection string.
+func addConnParams(connstring string, params []connParam) (string, error) {
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		u, err := url.Parse(connstring)
+		if err != nil {
+			return "", errors.New("could not parse connection string as a URL")
+		}
+
+		q := u.Query()
+		for _, p := range params {
+			if p.value != "" {
+				q.Set(p.key, p.value)
+			}
+		}
+		u.RawQuery = q.Encode()
+
+		return u.String(), nil
+	}
+
+	// The last occurrence of a keyword wins
+	for _, p := range params {
+		if p.value != "" {
+			v := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p.value)
+			connstring = strings.TrimSpace(fmt.Sprintf("%s %s='%s'", connstring, p.key, v))
+		}
+	}
+
+	return connstring, nil
+}
+
+// Number of statements cached on each connection, the default of pgx
+const stmtCacheCapacity = 512
+
+func setupPG(opts config) (*pgxpool.Pool, error) {
+	connstring, err := addConnParams(opts.connstring, []connParam{
+		{"sslmode", opts.sslMode},
+		{"sslrootcert", opts.sslRootCert},
+		{"sslcert", opts.sslCert},
+		{"sslkey", opts.sslKey},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := pgxpool.ParseConfig(connstring)
+	if err != nil {
+		return nil, redactError(err, connstring, "")
+	}
+
+	if opts.passwordFile != "" {
+		password, err := readPasswordFile(opts.passwordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ConnConfig.Password = password
+	}
+
+	// Name the sessions so that they can be found in pg_stat_activity
+	if _, ok := config.ConnConfig.RuntimeParams["application_name"]; !ok {
+		config.ConnConfig.RuntimeParams["application_name"] = defaultApplicationName
+	}
+
+	config.LazyConnect = opts.lazyConnect
+
+	// Measure the time spent opening connections when the pool needs a new
+	// one to give to a xact, the connection is established once
+	// BeforeConnect and AfterConnect are called
+	config.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+		if t := connTimingFrom(ctx); t != nil {
+			t.start = time.Now()
+		}
+		return nil
+	}
+
+	// Poolers like pgbouncer in transaction mode cannot keep the statements
+	// prepared by pgx on a server connection
+	config.ConnConfig.PreferSimpleProtocol = opts.simpleProto
+
+	// By default, pgx prepares the statements and reuses them on the same
+	// connection, unless the connection string sets statement_cache_mode
+	switch opts.stmtCache {
+	case "prepare":
+		config.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, stmtcache.ModePrepare, stmtCacheCapacity)
+		}
+	case "describe":
+		config.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, stmtcache.ModeDescribe, stmtCacheCapacity)
+		}
+	case "none":
+		config.ConnConfig.BuildStatementCache = nil
+	}
+
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if t := connTimingFrom(ctx); t != nil && !t.start.IsZero() {
+			t.connect = time.Since(t.start)
+		}
+
+		// random() evaluated by PostgreSQL is seeded per session, draw
+		// the seed from our generator so that it follows --seed
+		if opts.pgSetseed {
+			_, err := conn.Exec(ctx, "SELECT setseed($1)", serverSeed())
+			return err
+		}
+
+		return nil
+	}
+
+	conn, err := connectWithRetries(config, opts.connectRetries, opts.connectTimeout)
+	if err != nil {
+		return nil, redactError(err, connstring, config.ConnConfig.Password)
+	}
+
+	// Run a query so that a database that cannot be used fails at startup
+	// rather than on the first xact
+	if !opts.lazyConnect {
+		if err := pingPG(conn, opts.connectTimeout); err != nil {
+			conn.Close()
+			return nil, redactError(err, connstring, config.ConnConfig.Password)
+		}
+	}
+
+	return conn, nil
+}
+
+// pingPG runs SELECT 1 on a connection of the pool
+func pingPG(pool *pgxpool.Pool, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultStmtTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if _, err := pool.Exec(ctx, "SELECT 1"); err != nil {
+		return fmt.Errorf("could not query the database: %w", err)
+	}
+
+	return nil
+}
+
+// connectWithRetries creates the pool, when the connection fails it tries
+// again up to retries times or until the timeout expires, waiting longer
+// between each attempt, like when the database starts along with us
+func connectWithRetries(config *pgxpool.Config, retries int, timeout time.Duration) (*pgxpool.Pool, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		pool, err := pgxpool.ConnectConfig(ctx, config.Copy())
+		if err == nil {
+			return pool, nil
+		}
+
+		// Without timeout, the number of retries is the limit, without
+		// retries, the timeout is
+		if (retries == 0 && timeout == 0) || (retries > 0 && attempt > retries) {
+			return nil, err
+		}
+
+		log.Printf("could not connect to PostgreSQL, attempt %d, retrying in %s: %s", attempt, wait, redactError(err, config.ConnString(), config.ConnConfig.Password))
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+	}
+}
+
+// warmupPool opens every connection the pool can have and runs a trivial
+// query on each, so that the first xacts do not pay for the connection and
+// the setup of the backend
+func warmupPool(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	n := int(pool.Config().MaxConns)
+	conns := make([]*pgxpool.Conn, 0, n)
+
+	defer func() {
+		for _, c := range conns {
+			c.Release()
+		}
+	}()
+
+	// Connections are held until all are acquired so that each one is a
+	// different connection
+	for i := 0; i < n; i++ {
+		c, err := pool.Acquire(ctx)
+		if err != nil {
+			return len(conns), redactError(err, pool.Config().ConnString(), pool.Config().ConnConfig.Password)
+		}
+		conns = append(conns, c)
+
+		if _, err := c.Exec(ctx, "SELECT 1"); err != nil {
+			return len(conns), err
+		}
+	}
+
+	return len(conns), nil
+}
+
+func updatePoolConfig(pool *pgxpool.Pool, maxConns int) (*pgxpool.Pool, error) {
+	if maxConns < 1 {
+		return nil, fmt.Errorf("new pool size is too small")
 	}
 
 	config := pool.Config()
 	config.MaxConns = int32(maxConns)
 
+	// The current pool is only closed once the new one is there, so that
+	// it can be kept when the new one cannot be created
+	newPool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		return nil, redactError(err, config.ConnString(), config.ConnConfig.Password)
+	}
+
 	pool.Close()
 
-	return pgxpool.ConnectConfig(context.Background(), config)
+	return newPool, nil
 }
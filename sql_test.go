@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitScriptAndNormalizeSkipQuotedText(t *testing.T) {
+	script := "SELECT 'a;b', \"C;d\";\n-- a; comment\nSELECT $f$ X; $f$ /* c; /* nested; */ */ FROM   T;  -- end"
+
+	stmts, err := splitScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`SELECT 'a;b', "C;d"`,
+		"-- a; comment\nSELECT $f$ X; $f$ /* c; /* nested; */ */ FROM   T",
+	}
+	if !reflect.DeepEqual(stmts, expected) {
+		t.Fatalf("expected %q, got %q", expected, stmts)
+	}
+
+	// The same parts are kept as is when normalizing
+	if n := normalizeSQL(stmts[1], "case"); n != "-- a; comment\nselect $f$ X; $f$ /* c; /* nested; */ */ from t" {
+		t.Fatalf("unexpected normalized text: %q", n)
+	}
+
+	for _, bad := range []string{"SELECT 'a", "SELECT $$ a", "SELECT /* a"} {
+		if _, err := splitScript(bad); err == nil {
+			t.Errorf("expected an error splitting %q", bad)
+		}
+		if n := normalizeSQL(bad, "case"); n != bad {
+			t.Errorf("expected %q to be kept as is, got %q", bad, n)
+		}
+	}
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default duration of the rolling window used to compute the average
+// throughput
+const statsWindow = time.Minute
+
+// stats holds the last figures computed by gather, so that they can be read
+// from the REST API
+type stats struct {
+	m *sync.RWMutex
+
+	// Interval between two computations of the stats
+	Interval time.Duration
+
+	// Number of intervals used to compute the average
+	Window int
+
+	// Throughput over the last interval, in xacts/s
+	Instant float64
+
+	// Throughput averaged over the rolling window, in xacts/s
+	Average float64
+
+	// Number of failed xacts since startup or the last reset
+	Failures int
+
+	// Last failures, up to MaxFailures, the most recent last
+	RecentFailures []failure
+	MaxFailures    int
+
+	// Total time spent by the workers waiting to send their results to
+	// gather during the last interval
+	SendBlocked time.Duration
+
+	// Number of notifications received by the listeners during the last
+	// interval, and the mean time they took to arrive for those with a
+	// timestamp as payload
+	Notifications int64
+	NotifyLatency time.Duration
+
+	// Number of rows sent by COPY statements during the last interval
+	RowsCopied int64
+
+	// Time spent waiting for a connection and time spent running the xact
+	// once BEGIN returned, over the xacts of the last interval
+	AcquireWait latencies
+	ExecTime    latencies
+
+	// Number of connections opened to run the xacts of the last interval
+	// and the time it took, part of the acquire wait
+	Connects    int
+	ConnectTime latencies
+
+	// Number of xacts of the last interval that could not get a
+	// connection, by class of error
+	AcquireErrors map[string]int
+
+	// Number of xacts of the last interval that never began, because no
+	// connection could be acquired or BEGIN failed, they are left out of
+	// the latencies
+	NotBegun int
+
+	// Execution time of the statements reported by PostgreSQL, for the
+	// xacts with server timing
+	ServerTime latencies
+
+	// Duration of the FETCH of the statements run through a cursor
+	FetchTime latencies
+
+	// Spread of the total latency of the xacts of the last interval
+	TotalTime spread
+
+	// Counters of each xact since startup or the last reset, by xact id,
+	// and the time they started
+	Xacts         map[string]xactCounters
+	CountersSince time.Time
+
+	// Errors of the failed xacts since startup or the last reset, by xact
+	// id then by SQLSTATE, they are not part of the snapshot
+	xactErrors map[string]map[string]errorCount
+
+	// Distribution of the total latency of the xacts since startup or the
+	// last reset
+	Histogram histogram
+
+	// The circuit breaker paused the run because too many xacts failed
+	Tripped bool
+
+	// Number of workers running a xact and of workers waiting for a slot
+	// to run one, read when taking the snapshot
+	InFlight int64
+	Queued   int64
+
+	// Number of transactions of idle xacts held open right now
+	Held int64
+
+	// Number of workers waiting for a connection right now, they pile up
+	// when the pool is too small
+	AcquireWaiting int64
+
+	// Number of results waiting for gather at the end of the last interval
+	// and the size of the buffer, gather cannot keep up when it is full
+	ResultsQueue int
+	ResultsCap   int
+
+	// Time the current workload started, it is reset when the schedule
+	// changes or a new run is loaded
+	StartedAt time.Time
+
+	// Counters updated by the workers
+	live *liveCounters
+}
+
+// failure describes a failed xact
+type failure struct {
+	XactId   string
+	XactName string
+	Trace    string
+	Time     time.Time
+	Outcome  xactOutcome
+	Error    string
+	SQLState string
+}
+
+func newFailure(r xactResult) failure {
+	f := failure{
+		XactId:   r.xactId,
+		XactName: r.xactName,
+		Trace:    r.trace,
+		Time:     r.endTime,
+		Outcome:  r.outcome,
+	}
+
+	// The xact may have failed before it could begin
+	if f.Time.IsZero() {
+		f.Time = r.startTime
+	}
+
+	if err := r.failure(); err != nil {
+		f.Error = err.Error()
+		f.SQLState = sqlState(err)
+	}
+
+	return f
+}
+
+// logXactResult logs the timing of a xact: its total latency, from the wait
+// for a connection, and the time spent after BEGIN returned
+func logXactResult(name string, r xactResult) {
+	var exec time.Duration
+	if !r.beginTime.IsZero() && !r.endTime.IsZero() {
+		exec = r.endTime.Sub(r.beginTime)
+	}
+
+	end := r.endTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	log.Printf("run=%s xact=%s client=%d outcome=%s failed=%v total=%s exec=%s", name, xactLabel(r.xactId, r.xactName),
+		r.client, r.outcome, r.failed, end.Sub(r.startTime), exec)
+}
+
+// xactCounters accumulate the results of a xact
+type xactCounters struct {
+	Commits   int64
+	Rollbacks int64
+
+	// Runs ended by the server for being idle in transaction too long
+	Terminated int64
+
+	// Runs of idle xacts that held their transaction until the end
+	Held int64
+
+	// Runs that could not begin, for example when no connection could be
+	// acquired
+	NotRun int64
+
+	// Total duration of the runs that began, to compute the mean, and the
+	// part of it spent opening connections
+	TotalTime   time.Duration
+	ConnectTime time.Duration
+
+	// Outcome of the last run, empty until the xact runs
+	Last xactOutcome
+}
+
+func (c *xactCounters) add(r xactResult) {
+	if r.beginTime.IsZero() {
+		c.NotRun++
+		c.Last = NotRun
+		return
+	}
+
+	c.Last = r.outcome
+	c.ConnectTime += r.connectTime
+	switch r.outcome {
+	case Rollback:
+		c.Rollbacks++
+	case Terminated:
+		c.Terminated++
+	case Idle:
+		c.Held++
+	default:
+		c.Commits++
+	}
+
+	c.TotalTime += r.endTime.Sub(r.startTime)
+}
+
+func (c *xactCounters) merge(o xactCounters) {
+	c.Commits += o.Commits
+	c.Rollbacks += o.Rollbacks
+	c.Terminated += o.Terminated
+	c.Held += o.Held
+	c.NotRun += o.NotRun
+	c.TotalTime += o.TotalTime
+	c.ConnectTime += o.ConnectTime
+	if o.Last != "" {
+		c.Last = o.Last
+	}
+}
+
+// lastOutcome gives the outcome of the last run, NotRun when the xact never
+// ran
+func (c xactCounters) lastOutcome() xactOutcome {
+	if c.Last == "" {
+		return NotRun
+	}
+
+	return c.Last
+}
+
+// runs gives the number of runs that began, whatever their outcome
+func (c xactCounters) runs() int64 {
+	return c.Commits + c.Rollbacks + c.Terminated + c.Held
+}
+
+// mean gives the mean duration of the runs that began
+func (c xactCounters) mean() time.Duration {
+	n := c.runs()
+	if n == 0 {
+		return 0
+	}
+
+	return c.TotalTime / time.Duration(n)
+}
+
+// errorCount counts the xacts that failed with some SQLSTATE
+type errorCount struct {
+	Count    int64
+	LastSeen time.Time
+}
+
+// Key of the errors without SQLSTATE, like timeouts or lost connections
+const noSQLState = "client"
+
+// addXactError accounts the error of a failed xact in a map of errors by xact
+// id and SQLSTATE
+func addXactError(errs map[string]map[string]errorCount, r xactResult) {
+	err := r.failure()
+	if err == nil {
+		return
+	}
+
+	code := sqlState(err)
+	if code == "" {
+		code = noSQLState
+	}
+
+	byCode, ok := errs[r.xactId]
+	if !ok {
+		byCode = make(map[string]errorCount)
+		errs[r.xactId] = byCode
+	}
+
+	// The xact may have failed before it could begin
+	t := r.endTime
+	if t.IsZero() {
+		t = r.startTime
+	}
+
+	e := byCode[code]
+	e.Count++
+	if t.After(e.LastSeen) {
+		e.LastSeen = t
+	}
+	byCode[code] = e
+}
+
+// liveCounters are updated atomically by the workers while gather reads them,
+// they are kept out of the snapshot
+type liveCounters struct {
+	// Nanoseconds spent sending results during the current interval
+	sendBlocked int64
+
+	// Notifications received, the ones with a latency and their total
+	// latency in nanoseconds
+	notifications int64
+	notifyTimed   int64
+	notifyLatency int64
+
+	// Set to 1 when gather must forget the failures
+	reset int32
+
+	// Workers currently running a xact and waiting to run one
+	inFlight int64
+	queued   int64
+
+	// Transactions of idle xacts currently held, see holdTx
+	held int64
+
+	// Workers waiting for a connection from the pool
+	acquiring int64
+}
+
+// Range of the latency histogram, the buckets are spread linearly inside
+// each power of ten between the bounds
+const (
+	histogramMin = 10 * time.Microsecond
+	histogramMax = 100 * time.Second
+)
+
+// histogram counts durations in fixed buckets, so that its size does not
+// depend on the number of xacts
+type histogram struct {
+	// Upper bounds of the buckets, the extra last count is for the durations
+	// above the last bound
+	Bounds []time.Duration
+	Counts []int64
+}
+
+// newHistogram creates a log-linear histogram with steps buckets for each
+// power of ten, 9 gives the bounds 10µs, 20µs, ... 90µs, 100µs, 200µs...
+func newHistogram(steps int) histogram {
+	bounds := []time.Duration{histogramMin}
+	for d := histogramMin; d < histogramMax; d *= 10 {
+		for i := 1; i <= steps; i++ {
+			bounds = append(bounds, d+d*time.Duration(9*i)/time.Duration(steps))
+		}
+	}
+
+	return histogram{
+		Bounds: bounds,
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h histogram) add(d time.Duration) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return d <= h.Bounds[i] })
+	h.Counts[i]++
+}
+
+// merge adds the counts of a histogram with the same bounds
+func (h histogram) merge(o histogram) {
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+}
+
+// percentile gives the upper bound of the bucket holding the p-th percentile
+// of the durations, the last bound when it is above it
+func (h histogram) percentile(p int) time.Duration {
+	total := int64(0)
+	for _, c := range h.Counts {
+		total += c
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank := (total*int64(p) + 99) / 100
+	seen := int64(0)
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+func (h histogram) clear() {
+	for i := range h.Counts {
+		h.Counts[i] = 0
+	}
+}
+
+func (h histogram) copy() histogram {
+	c := histogram{
+		Bounds: h.Bounds,
+		Counts: make([]int64, len(h.Counts)),
+	}
+	copy(c.Counts, h.Counts)
+
+	return c
+}
+
+// latencies are percentiles of the durations measured during an interval
+type latencies struct {
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// computeLatencies gets the percentiles using the nearest rank, the slice is
+// sorted in place
+func computeLatencies(d []time.Duration) latencies {
+	if len(d) == 0 {
+		return latencies{}
+	}
+
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+
+	rank := func(p int) time.Duration {
+		i := (len(d)*p+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return d[i]
+	}
+
+	return latencies{P50: rank(50), P95: rank(95), P99: rank(99)}
+}
+
+// spread describes how the durations measured during an interval are
+// dispersed
+type spread struct {
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	Stddev time.Duration
+}
+
+// computeSpread gets the extremes, the mean and the population standard
+// deviation of the durations
+func computeSpread(d []time.Duration) spread {
+	if len(d) == 0 {
+		return spread{}
+	}
+
+	s := spread{Min: d[0], Max: d[0]}
+	sum := 0.0
+	for _, v := range d {
+		if v < s.Min {
+			s.Min = v
+		}
+		if v > s.Max {
+			s.Max = v
+		}
+		sum += float64(v)
+	}
+
+	mean := sum / float64(len(d))
+	variance := 0.0
+	for _, v := range d {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	variance /= float64(len(d))
+
+	s.Mean = time.Duration(mean)
+	s.Stddev = time.Duration(math.Sqrt(variance))
+
+	return s
+}
+
+// formatCounts lists counts by name sorted by name, like "auth=1,
+// conn-refused=2"
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for n := range counts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, n := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", n, counts[n]))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// breaker tells dispatch to pause the run when the ratio of failed xacts
+// over the last intervals exceeds the threshold, it is disabled when the
+// threshold is 0
+type breaker struct {
+	threshold float64
+	window    int
+	trip      chan struct{}
+
+	// Failed and total xacts of each interval in the window
+	failed    []int
+	total     []int
+	sumFailed int
+	sumTotal  int
+}
+
+func newBreaker(threshold float64, window int, trip chan struct{}) *breaker {
+	return &breaker{
+		threshold: threshold,
+		window:    window,
+		trip:      trip,
+		failed:    make([]int, 0, window),
+		total:     make([]int, 0, window),
+	}
+}
+
+// failureWatch stops low-runner when the ratio of failed xacts exceeds the
+// rate for a number of intervals in a row, unlike the breaker which pauses
+// a single run. Intervals without xacts do not count. It is disabled when the
+// rate is 0.
+type failureWatch struct {
+	rate    float64
+	windows int
+	above   int
+	abort   func()
+}
+
+func newFailureWatch(rate float64, windows int, abort func()) *failureWatch {
+	return &failureWatch{rate: rate, windows: windows, abort: abort}
+}
+
+// add accounts the xacts of an interval, it tells once when low-runner must
+// stop
+func (w *failureWatch) add(failed int, total int) bool {
+	if w.rate <= 0 || total == 0 {
+		return false
+	}
+
+	if float64(failed)/float64(total) <= w.rate {
+		w.above = 0
+		return false
+	}
+
+	w.above++
+
+	return w.above == w.windows
+}
+
+// Number of intervals in a row with too many workers waiting for a
+// connection before acquireWatch warns
+const acquireWatchIntervals = 5
+
+// acquireWatch tells when at least threshold workers keep waiting for a
+// connection, at the end of acquireWatchIntervals intervals in a row. It
+// tells once until the number of workers waiting goes below the threshold,
+// it is disabled when the threshold is 0.
+type acquireWatch struct {
+	threshold int64
+	above     int
+}
+
+func newAcquireWatch(threshold int) *acquireWatch {
+	return &acquireWatch{threshold: int64(threshold)}
+}
+
+// add accounts the workers waiting at the end of an interval
+func (w *acquireWatch) add(waiting int64) bool {
+	if w.threshold <= 0 {
+		return false
+	}
+
+	if waiting < w.threshold {
+		w.above = 0
+		return false
+	}
+
+	w.above++
+
+	return w.above == acquireWatchIntervals
+}
+
+// add accounts the xacts of an interval and trips the breaker when the
+// window is full and the failure ratio is too high, it starts with an empty
+// window afterwards
+func (b *breaker) add(failed int, total int) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+
+	if len(b.total) >= b.window {
+		b.sumFailed -= b.failed[0]
+		b.sumTotal -= b.total[0]
+		b.failed = b.failed[1:]
+		b.total = b.total[1:]
+	}
+
+	b.failed = append(b.failed, failed)
+	b.total = append(b.total, total)
+	b.sumFailed += failed
+	b.sumTotal += total
+
+	if len(b.total) < b.window || b.sumTotal == 0 {
+		return false
+	}
+
+	if float64(b.sumFailed)/float64(b.sumTotal) <= b.threshold {
+		return false
+	}
+
+	b.failed = b.failed[:0]
+	b.total = b.total[:0]
+	b.sumFailed = 0
+	b.sumTotal = 0
+
+	// dispatch may already have a trip to process
+	select {
+	case b.trip <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// newStats prepares the stats for the given interval, when window is 0 the
+// average covers the default window duration. The histogram has
+// histogramSteps buckets for each power of ten. The last maxFailures failures
+// are kept.
+func newStats(interval time.Duration, window int, histogramSteps int, maxFailures int) *stats {
+	if window < 1 {
+		window = int(statsWindow / interval)
+		if window < 1 {
+			window = 1
+		}
+	}
+
+	return &stats{
+		m:              &sync.RWMutex{},
+		Interval:       interval,
+		Window:         window,
+		Xacts:          make(map[string]xactCounters),
+		AcquireErrors:  make(map[string]int),
+		xactErrors:     make(map[string]map[string]errorCount),
+		CountersSince:  time.Now(),
+		Histogram:      newHistogram(histogramSteps),
+		RecentFailures: make([]failure, 0),
+		MaxFailures:    maxFailures,
+		live:           &liveCounters{},
+	}
+}
+
+// enterXact and leaveXact surround the run of a xact by a worker
+func (s *stats) enterXact() {
+	atomic.AddInt64(&s.live.inFlight, 1)
+}
+
+func (s *stats) leaveXact() {
+	atomic.AddInt64(&s.live.inFlight, -1)
+}
+
+// enterQueue and leaveQueue surround the wait of a worker for a slot of the
+// concurrency cap
+func (s *stats) enterQueue() {
+	atomic.AddInt64(&s.live.queued, 1)
+}
+
+func (s *stats) leaveQueue() {
+	atomic.AddInt64(&s.live.queued, -1)
+}
+
+func (s *stats) addSendBlocked(d time.Duration) {
+	atomic.AddInt64(&s.live.sendBlocked, int64(d))
+}
+
+// addNotification accounts a notification received by a listener, a
+// negative latency means it is unknown
+func (s *stats) addNotification(latency time.Duration) {
+	atomic.AddInt64(&s.live.notifications, 1)
+	if latency >= 0 {
+		atomic.AddInt64(&s.live.notifyTimed, 1)
+		atomic.AddInt64(&s.live.notifyLatency, int64(latency))
+	}
+}
+
+// snapshot returns a copy of the stats safe to use without the lock
+func (s *stats) snapshot() stats {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	c := *s
+	c.InFlight = atomic.LoadInt64(&s.live.inFlight)
+	c.Queued = atomic.LoadInt64(&s.live.queued)
+	c.Held = atomic.LoadInt64(&s.live.held)
+	c.AcquireWaiting = atomic.LoadInt64(&s.live.acquiring)
+	c.Xacts = make(map[string]xactCounters, len(s.Xacts))
+	for k, v := range s.Xacts {
+		c.Xacts[k] = v
+	}
+	c.AcquireErrors = make(map[string]int, len(s.AcquireErrors))
+	for k, v := range s.AcquireErrors {
+		c.AcquireErrors[k] = v
+	}
+	c.Histogram = s.Histogram.copy()
+	c.RecentFailures = append([]failure{}, s.RecentFailures...)
+
+	return c
+}
+
+// xactCounters gives the counters of a xact, they are all zero when the xact
+// has not run yet
+func (s *stats) xactCounters(id string) xactCounters {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.Xacts[id]
+}
+
+// errorsOf gives a copy of the counts of the errors of a xact by SQLSTATE
+func (s *stats) errorsOf(id string) map[string]errorCount {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	errs := make(map[string]errorCount, len(s.xactErrors[id]))
+	for k, v := range s.xactErrors[id] {
+		errs[k] = v
+	}
+
+	return errs
+}
+
+// restart records the start of a new workload
+func (s *stats) restart() {
+	s.m.Lock()
+	s.StartedAt = time.Now()
+	s.m.Unlock()
+}
+
+func (s *stats) setTripped(tripped bool) {
+	s.m.Lock()
+	s.Tripped = tripped
+	s.m.Unlock()
+}
+
+// reset clears the failures, the counters of the xacts and the histogram
+func (s *stats) reset() {
+	s.m.Lock()
+	s.Failures = 0
+	s.RecentFailures = make([]failure, 0)
+	s.Xacts = make(map[string]xactCounters)
+	s.xactErrors = make(map[string]map[string]errorCount)
+	s.CountersSince = time.Now()
+	s.Histogram.clear()
+	s.m.Unlock()
+
+	atomic.StoreInt32(&s.live.reset, 1)
+}
+
+// resultSink receives every result gathered, to output them in some format.
+// Gather calls record for each result, flush at the end of each interval and
+// close once the last results are recorded, from its goroutine only.
+type resultSink interface {
+	record(r xactResult)
+	flush()
+	close()
+}
+
+// slowLog logs the xacts taking at least the threshold, with their trace id
+// when the queries are tagged, to find them in the logs of PostgreSQL
+type slowLog struct {
+	name      string
+	threshold time.Duration
+}
+
+func (l slowLog) record(r xactResult) {
+	if r.beginTime.IsZero() || r.endTime.IsZero() {
+		return
+	}
+
+	total := r.endTime.Sub(r.startTime)
+	if total < l.threshold {
+		return
+	}
+
+	trace := r.trace
+	if trace == "" {
+		trace = "none"
+	}
+
+	log.Printf("run=%s slow xact=%s trace=%s total=%s acquire=%s exec=%s", l.name, xactLabel(r.xactId, r.xactName), trace,
+		total, r.acquireTime.Sub(r.startTime), r.endTime.Sub(r.beginTime))
+}
+
+func (l slowLog) flush() {}
+
+func (l slowLog) close() {}
+
+// Gather the results from workers and compute stats, the results are passed
+// to the sinks too. When results is closed, the last interval is merged into
+// the stats and gather returns.
+func gather(name string, results chan xactResult, st *stats, b *breaker, w *acquireWatch, fw *failureWatch, sinks []resultSink) {
+	count := 0
+	failed := 0
+	copied := int64(0)
+	interval := st.Interval
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	// Keep enough samples to cover the rolling window, the sum is kept up
+	// to date as samples come in and out to avoid iterating over the whole
+	// window on each tick, which matters with small intervals
+	maxSamples := st.Window
+	window := time.Duration(maxSamples) * interval
+	xacts := make([]int, 0, maxSamples)
+	sum := 0
+
+	// Failures since startup or the last reset, only the last ones are
+	// kept
+	failures := 0
+	recent := make([]failure, 0, st.MaxFailures)
+
+	// Durations measured on the xacts of the current interval
+	acquireWaits := make([]time.Duration, 0)
+	connectTimes := make([]time.Duration, 0)
+	acquireErrors := make(map[string]int)
+	notBegun := 0
+	execTimes := make([]time.Duration, 0)
+	serverTimes := make([]time.Duration, 0)
+	fetchTimes := make([]time.Duration, 0)
+	totalTimes := make([]time.Duration, 0)
+
+	// Counters and errors of the xacts over the current interval, merged
+	// into the lifetime counters on each tick
+	counters := make(map[string]xactCounters)
+	xactErrors := make(map[string]map[string]errorCount)
+
+	// Total latency of the xacts of the current interval, merged the same
+	// way, the bounds never change
+	hist := histogram{
+		Bounds: st.Histogram.Bounds,
+		Counts: make([]int64, len(st.Histogram.Counts)),
+	}
+
+	closed := false
+	for {
+
+	out:
+		for {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					closed = true
+					break out
+				}
+
+				if logXacts {
+					logXactResult(name, res)
+				}
+				if res.failed {
+					failures++
+					if st.MaxFailures > 0 {
+						if len(recent) >= st.MaxFailures {
+							recent = append(recent[:0], recent[1:]...)
+						}
+						recent = append(recent, newFailure(res))
+					}
+					failed++
+					addXactError(xactErrors, res)
+				} else {
+					count++
+				}
+
+				for _, s := range res.stmts {
+					copied += s.copied
+					if s.serverTime > 0 {
+						serverTimes = append(serverTimes, s.serverTime)
+					}
+					fetchTimes = append(fetchTimes, s.fetches...)
+				}
+
+				xc := counters[res.xactId]
+				xc.add(res)
+				counters[res.xactId] = xc
+
+				for _, s := range sinks {
+					s.record(res)
+				}
+
+				// The start time is taken before acquiring the
+				// connection so this shows the contention on the pool
+				if !res.acquireTime.IsZero() {
+					acquireWaits = append(acquireWaits, res.acquireTime.Sub(res.startTime))
+				}
+
+				if res.connectTime > 0 {
+					connectTimes = append(connectTimes, res.connectTime)
+				}
+
+				if res.acquireError != "" {
+					acquireErrors[res.acquireError]++
+				}
+
+				// Without a begin time, the xact failed on the
+				// connection, its times mean nothing
+				if res.beginTime.IsZero() {
+					notBegun++
+				} else if !res.endTime.IsZero() {
+					execTimes = append(execTimes, res.endTime.Sub(res.beginTime))
+					totalTimes = append(totalTimes, res.endTime.Sub(res.startTime))
+					hist.add(res.endTime.Sub(res.startTime))
+				}
+
+				select {
+				case <-tick.C:
+					break out
+				default:
+				}
+			case <-tick.C:
+				break out
+			}
+		}
+
+		if len(xacts) >= maxSamples {
+			sum -= xacts[0]
+			xacts = xacts[1:]
+		}
+
+		xacts = append(xacts, count)
+		sum += count
+
+		instant := float64(count) / interval.Seconds()
+		avg := float64(sum) / float64(len(xacts)) / interval.Seconds()
+		blocked := time.Duration(atomic.SwapInt64(&st.live.sendBlocked, 0))
+
+		notifications := atomic.SwapInt64(&st.live.notifications, 0)
+		notifyTimed := atomic.SwapInt64(&st.live.notifyTimed, 0)
+		notifyLatency := time.Duration(0)
+		if notifyTimed > 0 {
+			notifyLatency = time.Duration(atomic.SwapInt64(&st.live.notifyLatency, 0) / notifyTimed)
+		}
+
+		if b.add(failed, count+failed) {
+			st.setTripped(true)
+			log.Printf("run=%s ERROR: more than %.0f%% of the xacts failed over the last %d intervals, the circuit breaker pauses the run\n", name, b.threshold*100, b.window)
+		}
+
+		if fw.add(failed, count+failed) {
+			quietLog.Printf("run=%s ERROR: more than %.0f%% of the xacts failed for %d intervals in a row, stopping with an error\n", name, fw.rate*100, fw.windows)
+			fw.abort()
+		}
+
+		if waiting := atomic.LoadInt64(&st.live.acquiring); w.add(waiting) {
+			log.Printf("run=%s WARNING: %d workers waiting for a connection for the last %d intervals, the pool looks too small for the workers and max_concurrency of the schedule\n",
+				name, waiting, acquireWatchIntervals)
+		}
+
+		acquireWait := computeLatencies(acquireWaits)
+		connects := len(connectTimes)
+		connectTime := computeLatencies(connectTimes)
+		execTime := computeLatencies(execTimes)
+		serverTime := computeLatencies(serverTimes)
+		fetchTime := computeLatencies(fetchTimes)
+		totalTime := computeSpread(totalTimes)
+
+		if atomic.SwapInt32(&st.live.reset, 0) == 1 {
+			failures = 0
+			recent = recent[:0]
+		}
+
+		st.m.Lock()
+		st.Instant = instant
+		st.Average = avg
+		st.Failures = failures
+		st.ResultsQueue = len(results)
+		st.ResultsCap = cap(results)
+		st.RecentFailures = append(st.RecentFailures[:0], recent...)
+		st.SendBlocked = blocked
+		st.Notifications = notifications
+		st.NotifyLatency = notifyLatency
+		st.RowsCopied = copied
+		st.AcquireWait = acquireWait
+		st.Connects = connects
+		st.ConnectTime = connectTime
+		st.AcquireErrors = acquireErrors
+		st.NotBegun = notBegun
+		st.ExecTime = execTime
+		st.ServerTime = serverTime
+		st.FetchTime = fetchTime
+		st.TotalTime = totalTime
+		for id, c := range counters {
+			xc := st.Xacts[id]
+			xc.merge(c)
+			st.Xacts[id] = xc
+		}
+		for id, byCode := range xactErrors {
+			all, ok := st.xactErrors[id]
+			if !ok {
+				all = make(map[string]errorCount)
+				st.xactErrors[id] = all
+			}
+
+			for code, e := range byCode {
+				a := all[code]
+				a.Count += e.Count
+				if e.LastSeen.After(a.LastSeen) {
+					a.LastSeen = e.LastSeen
+				}
+				all[code] = a
+			}
+		}
+		st.Histogram.merge(hist)
+		st.m.Unlock()
+
+		for _, s := range sinks {
+			s.flush()
+		}
+
+		log.Printf("run=%s instant xacts/s=%.2f, %s avg xacts/s=%.2f, failures=%d, in flight=%d, queued=%d, results queue=%d/%d, send blocked=%s\n", name, instant, window, avg, failures,
+			atomic.LoadInt64(&st.live.inFlight), atomic.LoadInt64(&st.live.queued), len(results), cap(results), blocked)
+		if len(totalTimes) > 0 {
+			log.Printf("run=%s latency min=%s max=%s mean=%s stddev=%s\n", name, totalTime.Min, totalTime.Max, totalTime.Mean, totalTime.Stddev)
+		}
+		if len(acquireWaits) > 0 {
+			log.Printf("run=%s acquire wait p50=%s p95=%s p99=%s, exec time p50=%s p95=%s p99=%s\n", name,
+				acquireWait.P50, acquireWait.P95, acquireWait.P99, execTime.P50, execTime.P95, execTime.P99)
+		}
+		if connects > 0 {
+			log.Printf("run=%s connects=%d, connect time p50=%s p95=%s p99=%s\n", name, connects, connectTime.P50, connectTime.P95, connectTime.P99)
+		}
+		if notBegun > 0 {
+			log.Printf("run=%s never began=%d, acquire errors: %s\n", name, notBegun, formatCounts(acquireErrors))
+		}
+		if len(serverTimes) > 0 {
+			log.Printf("run=%s server time p50=%s p95=%s p99=%s\n", name, serverTime.P50, serverTime.P95, serverTime.P99)
+		}
+		if len(fetchTimes) > 0 {
+			log.Printf("run=%s fetches=%d, fetch time p50=%s p95=%s p99=%s\n", name, len(fetchTimes), fetchTime.P50, fetchTime.P95, fetchTime.P99)
+		}
+		if held := atomic.LoadInt64(&st.live.held); held > 0 {
+			log.Printf("run=%s transactions held idle=%d\n", name, held)
+		}
+		if notifications > 0 {
+			log.Printf("run=%s notifications=%d, notify latency=%s\n", name, notifications, notifyLatency)
+		}
+		if copied > 0 {
+			log.Printf("run=%s rows copied=%d\n", name, copied)
+		}
+		count = 0
+		failed = 0
+		copied = 0
+		acquireWaits = acquireWaits[:0]
+		connectTimes = connectTimes[:0]
+		acquireErrors = make(map[string]int)
+		notBegun = 0
+		execTimes = execTimes[:0]
+		serverTimes = serverTimes[:0]
+		fetchTimes = fetchTimes[:0]
+		totalTimes = totalTimes[:0]
+		counters = make(map[string]xactCounters)
+		xactErrors = make(map[string]map[string]errorCount)
+		hist.clear()
+
+		if closed {
+			for _, s := range sinks {
+				s.close()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGatherMergesLastIntervalWhenClosed(t *testing.T) {
+	// The interval is long enough that no tick comes during the test, the
+	// results are only merged when the channel is closed
+	st := newStats(time.Hour, 1, 10, 0)
+	results := make(chan xactResult, 10)
+
+	done := make(chan struct{})
+	go func() {
+		gather("test", results, st, newBreaker(0, 1, make(chan struct{}, 1)), newAcquireWatch(0), newFailureWatch(0, 1, func() {}), nil)
+		close(done)
+	}()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		results <- xactResult{xactId: "x", outcome: Commit, startTime: start, beginTime: start, endTime: start.Add(time.Millisecond)}
+	}
+	close(results)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gather did not return once results was closed")
+	}
+
+	if c := st.snapshot().Xacts["x"]; c.Commits != 3 {
+		t.Fatalf("expected 3 commits in the stats, got %d", c.Commits)
+	}
+}
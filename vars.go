@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// cliVars are the variables given with --var, they apply to all the runs. It
+// is set once at startup.
+var cliVars map[string]string
+
+var varName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var varRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// parseVars reads key=value pairs, like the ones of --var
+func parseVars(pairs []string) (map[string]string, error) {
+	vars := make(map[string]string, len(pairs))
+
+	for _, p := range pairs {
+		i := strings.Index(p, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid variable %q, expected key=value", p)
+		}
+
+		if !varName.MatchString(p[:i]) {
+			return nil, fmt.Errorf("invalid variable name %q", p[:i])
+		}
+
+		vars[p[:i]] = p[i+1:]
+	}
+
+	return vars, nil
+}
+
+// checkVars validates the names of the variables of a work
+func checkVars(vars map[string]string) error {
+	for k := range vars {
+		if !varName.MatchString(k) {
+			return fmt.Errorf("invalid variable name %q", k)
+		}
+	}
+
+	return nil
+}
+
+// expandVars replaces the ${NAME} references of a text. The value is looked
+// up in the variables of the run, then the ones of --var, then the
+// environment. All the references that cannot be resolved are reported in
+// the error.
+func expandVars(text string, vars map[string]string) (string, error) {
+	missing := make(map[string]bool)
+
+	out := varRef.ReplaceAllStringFunc(text, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+
+		if v, ok := vars[name]; ok {
+			return v
+		}
+
+		if v, ok := cliVars[name]; ok {
+			return v
+		}
+
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+
+		missing[name] = true
+		return ref
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for n := range missing {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return "", fmt.Errorf("undefined variables: %s", strings.Join(names, ", "))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// A change is loaded once no event came for watchSettle, so that an editor
+// writing the file in several steps does not get a partial file loaded
+const watchSettle = 300 * time.Millisecond
+
+// watchWorkFile loads the work file again when it changes and replaces the
+// run with it, like POST /v1/run does. When the file cannot be loaded, the
+// current run is kept. The options found in the file only apply at startup.
+func watchWorkFile(ctx context.Context, path string, opts config, rn *runner) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("could not watch the work file: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	// Editors often save by writing a new file renamed over the old one,
+	// which ends a watch on the file itself: the directory is watched and
+	// the events are filtered on the name of the file
+	target := filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(target)); err != nil {
+		log.Printf("could not watch the work file: %s", err)
+		return
+	}
+
+	settle := time.NewTimer(watchSettle)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("run=%s ERROR: watching the work file: %s", rn.name, err)
+
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if filepath.Clean(ev.Name) != target || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			if !settle.Stop() {
+				select {
+				case <-settle.C:
+				default:
+				}
+			}
+			settle.Reset(watchSettle)
+
+		case <-settle.C:
+			reloadWorkFile(path, opts, rn)
+		}
+	}
+}
+
+// reloadWorkFile replaces the run with the contents of the work file
+func reloadWorkFile(path string, opts config, rn *runner) {
+	r, err := loadRunFromFile(path, &opts)
+	if err != nil {
+		log.Printf("run=%s ERROR: work file changed but %s, keeping the current run", rn.name, err)
+		return
+	}
+
+	// Only the first load can start paused without workers, the pool of a
+	// running run cannot be sized for 0 workers
+	if r.Schedule.Workers < 1 {
+		log.Printf("run=%s ERROR: work file changed but it has no workers in its schedule, keeping the current run", rn.name)
+		return
+	}
+
+	log.Printf("run=%s work file %s changed, loading the new run", rn.name, path)
+
+	rn.work.m.Lock()
+	rn.work.load(r.Schedule, r.Work)
+	rn.work.m.Unlock()
+
+	rn.stats.restart()
+	notifyDispatch(rn.ctrl)
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// adjustWorkers adds a worker to the run on SIGUSR1 and removes one on
+// SIGUSR2, to tune the schedule from a terminal without the REST API. The
+// change goes to dispatch like the ones of the API.
+func adjustWorkers(ctx context.Context, rn *runner) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			rn.work.m.Lock()
+			s := rn.work.Schedule
+			if sig == syscall.SIGUSR1 {
+				s.Workers++
+			} else if s.Workers > 1 {
+				s.Workers--
+			} else {
+				rn.work.m.Unlock()
+				log.Printf("run=%s received %s, keeping the last worker", rn.name, sig)
+				continue
+			}
+
+			log.Printf("run=%s received %s, workers %d→%d", rn.name, sig, rn.work.Schedule.Workers, s.Workers)
+			rn.work.setSchedule(s)
+			rn.work.m.Unlock()
+
+			notifyDispatch(rn.ctrl)
+		}
+	}
+}
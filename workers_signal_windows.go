@@ -0,0 +1,6 @@
+package main
+
+import "context"
+
+// adjustWorkers does nothing as there is no SIGUSR1 and SIGUSR2 on Windows
+func adjustWorkers(ctx context.Context, rn *runner) {}